@@ -1,15 +1,19 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/srelab/url-shortener/pkg"
 
 	"github.com/srelab/url-shortener/pkg/g"
 	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores"
 	"github.com/srelab/url-shortener/pkg/util"
 	"github.com/urfave/cli"
 )
@@ -22,7 +26,7 @@ func main() {
 		Compiled: time.Now(),
 		Authors:  []cli.Author{{Name: g.AUTHOR, Email: g.MAIL}},
 		Before: func(c *cli.Context) error {
-			fmt.Fprintf(c.App.Writer, util.StripIndent(
+			fmt.Fprint(c.App.Writer, util.StripIndent(
 				`
 				#     # ######  #           #####  #     # ####### ######  ####### 
 				#     # #     # #          #     # #     # #     # #     #    #    
@@ -49,7 +53,7 @@ func main() {
 					}
 
 					if err := g.ReadInConfig(ctx); err != nil {
-						logger.Fatal("could not read config: %v", err)
+						logger.Fatalf("could not read config: %v", err)
 					}
 					logger.InitLogger()
 
@@ -58,7 +62,7 @@ func main() {
 
 					stop, err := pkg.Start()
 					if err != nil {
-						logger.Fatal("could not init shortener: %v", err)
+						logger.Fatalf("could not init shortener: %v", err)
 					}
 
 					<-canStop
@@ -69,8 +73,104 @@ func main() {
 					&cli.StringFlag{Name: "config, c", Usage: "Load configuration from `FILE`"},
 				},
 			},
+			{
+				Name:  "apikey",
+				Usage: "manage the api keys of the backend",
+				Subcommands: []cli.Command{
+					{
+						Name:  "create",
+						Usage: "create an api key, the key is only printed once",
+						Action: withStore(func(ctx *cli.Context, store *stores.Store) error {
+							key, apiKey, err := store.CreateAPIKey(ctx.String("owner"), ctx.StringSlice("scope"))
+							if err != nil {
+								return err
+							}
+
+							fmt.Printf("created api key %s of %s with the scopes %s\n%s\n",
+								apiKey.ID, apiKey.Owner, strings.Join(apiKey.Scopes, ", "), key)
+							return nil
+						}),
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "config, c", Usage: "Load configuration from `FILE`"},
+							&cli.StringFlag{Name: "owner", Usage: "owner of the URLs created with the key"},
+							&cli.StringSliceFlag{Name: "scope", Usage: "scope of the key, 'create', 'read' or 'admin', can be repeated"},
+						},
+					},
+					{
+						Name:  "list",
+						Usage: "list the api keys",
+						Action: withStore(func(ctx *cli.Context, store *stores.Store) error {
+							keys, err := store.GetAPIKeys()
+							if err != nil {
+								return err
+							}
+
+							w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+							fmt.Fprintln(w, "ID\tOWNER\tSCOPES\tCREATED")
+							for _, key := range keys {
+								fmt.Fprintf(w, "%s\t%s\t%s\t%s\n",
+									key.ID, key.Owner, strings.Join(key.Scopes, ","), key.CreatedOn.Format(g.DefaultTimeFormat))
+							}
+
+							return w.Flush()
+						}),
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "config, c", Usage: "Load configuration from `FILE`"},
+						},
+					},
+					{
+						Name:      "delete",
+						Usage:     "revoke an api key",
+						ArgsUsage: "ID",
+						Action: withStore(func(ctx *cli.Context, store *stores.Store) error {
+							if ctx.NArg() != 1 {
+								return errors.New("the id of the api key is required")
+							}
+
+							return store.DeleteAPIKey(ctx.Args().First())
+						}),
+						Flags: []cli.Flag{
+							&cli.StringFlag{Name: "config, c", Usage: "Load configuration from `FILE`"},
+						},
+					},
+				},
+			},
 		},
 	}
 
 	app.Run(os.Args)
 }
+
+// withStore runs the action with the store of the configured backend, a failure exits the program
+func withStore(action func(*cli.Context, *stores.Store) error) func(*cli.Context) {
+	return func(ctx *cli.Context) {
+		if ctx.String("config") == "" {
+			fmt.Println("config is required")
+			os.Exit(127)
+		}
+
+		if err := g.ReadInConfig(ctx); err != nil {
+			logger.Fatalf("could not read config: %v", err)
+		}
+		logger.InitLogger()
+
+		// the keys would be stored in the memory of this process and lost when it exits
+		if g.GetConfig().Backend == "memory" {
+			fmt.Println("api keys can not be managed with the memory backend, use bearer tokens instead")
+			os.Exit(1)
+		}
+
+		store, err := stores.New()
+		if err != nil {
+			logger.Fatalf("could not create store: %v", err)
+		}
+
+		err = action(ctx, store)
+		store.Close()
+
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+}
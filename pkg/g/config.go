@@ -10,13 +10,95 @@ import (
 
 // Configuration are the available config values
 type Configuration struct {
-	ListenAddr      string      `yaml:"ListenAddr" env:"LISTEN_ADDR"`
-	DataDir         string      `yaml:"DataDir" env:"DATA_DIR"`
-	Backend         string      `yaml:"Backend" env:"BACKEND"`
-	Location        string      `yaml:"Location" env:"LOCATION"`
-	ShortedIDLength int         `yaml:"ShortedIDLength" env:"SHORTED_ID_LENGTH"`
-	Redis           redisConfig `yaml:"Redis" env:"REDIS"`
-	Log             LogConfig   `yaml:"Log" env:"LOG"`
+	ListenAddr                  string          `yaml:"ListenAddr" env:"LISTEN_ADDR"`
+	DataDir                     string          `yaml:"DataDir" env:"DATA_DIR"`
+	Backend                     string          `yaml:"Backend" env:"BACKEND"`
+	Location                    string          `yaml:"Location" env:"LOCATION"`
+	ShortedIDLength             int             `yaml:"ShortedIDLength" env:"SHORTED_ID_LENGTH"`
+	ShortedIDGenerator          string          `yaml:"ShortedIDGenerator" env:"SHORTED_ID_GENERATOR"`
+	ShortedIDAlphabet           string          `yaml:"ShortedIDAlphabet" env:"SHORTED_ID_ALPHABET"`
+	ShortedIDMaxLength          int             `yaml:"ShortedIDMaxLength" env:"SHORTED_ID_MAX_LENGTH"`
+	ShortedIDCollisionThreshold int             `yaml:"ShortedIDCollisionThreshold" env:"SHORTED_ID_COLLISION_THRESHOLD"`
+	ShortedIDObfuscationKey     string          `yaml:"ShortedIDObfuscationKey" env:"SHORTED_ID_OBFUSCATION_KEY"`
+	CustomIDMaxLength           int             `yaml:"CustomIDMaxLength" env:"CUSTOM_ID_MAX_LENGTH"`
+	ReservedIDs                 []string        `yaml:"ReservedIDs" env:"RESERVED_IDS"`
+	DedupeURLs                  bool            `yaml:"DedupeURLs" env:"DEDUPE_URLS"`
+	RedirectType                int             `yaml:"RedirectType" env:"REDIRECT_TYPE"`
+	ExpiredRetention            string          `yaml:"ExpiredRetention" env:"EXPIRED_RETENTION"`
+	ExpiredPage                 string          `yaml:"ExpiredPage" env:"EXPIRED_PAGE"`
+	NotYetActiveStatus          int             `yaml:"NotYetActiveStatus" env:"NOT_YET_ACTIVE_STATUS"`
+	NotYetActivePage            string          `yaml:"NotYetActivePage" env:"NOT_YET_ACTIVE_PAGE"`
+	TrustedProxies              []string        `yaml:"TrustedProxies" env:"TRUSTED_PROXIES"`
+	Password                    passwordConfig  `yaml:"Password" env:"PASSWORD"`
+	Visits                      visitsConfig    `yaml:"Visits" env:"VISITS"`
+	Auth                        authConfig      `yaml:"Auth" env:"AUTH"`
+	RateLimit                   rateLimitConfig `yaml:"RateLimit" env:"RATE_LIMIT"`
+	URLPolicy                   urlPolicyConfig `yaml:"URLPolicy" env:"URL_POLICY"`
+	Chains                      chainsConfig    `yaml:"Chains" env:"CHAINS"`
+	Redis                       redisConfig     `yaml:"Redis" env:"REDIS"`
+	Bolt                        boltConfig      `yaml:"Bolt" env:"BOLT"`
+	SQL                         sqlConfig       `yaml:"SQL" env:"SQL"`
+	Memory                      memoryConfig    `yaml:"Memory" env:"MEMORY"`
+	Log                         LogConfig       `yaml:"Log" env:"LOG"`
+}
+
+type visitsConfig struct {
+	QueueSize int `yaml:"QueueSize" env:"QUEUE_SIZE"`
+	BatchSize int `yaml:"BatchSize" env:"BATCH_SIZE"`
+}
+
+type rateLimitConfig struct {
+	Enabled  bool       `yaml:"Enabled" env:"ENABLED"`
+	Create   RateConfig `yaml:"Create" env:"CREATE"`
+	Read     RateConfig `yaml:"Read" env:"READ"`
+	Redirect RateConfig `yaml:"Redirect" env:"REDIRECT"`
+}
+
+type urlPolicyConfig struct {
+	AllowedSchemes         []string `yaml:"AllowedSchemes" env:"ALLOWED_SCHEMES"`
+	AllowedDomains         []string `yaml:"AllowedDomains" env:"ALLOWED_DOMAINS"`
+	DeniedDomains          []string `yaml:"DeniedDomains" env:"DENIED_DOMAINS"`
+	RejectPrivateAddresses bool     `yaml:"RejectPrivateAddresses" env:"REJECT_PRIVATE_ADDRESSES"`
+	ResolveTimeout         string   `yaml:"ResolveTimeout" env:"RESOLVE_TIMEOUT"`
+}
+
+type chainsConfig struct {
+	Hosts    []string `yaml:"Hosts" env:"HOSTS"`
+	MaxDepth int      `yaml:"MaxDepth" env:"MAX_DEPTH"`
+	Flatten  bool     `yaml:"Flatten" env:"FLATTEN"`
+}
+
+// RateConfig allows the requests within the period, with bursts of up to Burst requests
+type RateConfig struct {
+	Requests int    `yaml:"Requests" env:"REQUESTS"`
+	Period   string `yaml:"Period" env:"PERIOD"`
+	Burst    int    `yaml:"Burst" env:"BURST"`
+}
+
+type authConfig struct {
+	Enabled bool      `yaml:"Enabled" env:"ENABLED"`
+	JWT     JWTConfig `yaml:"JWT" env:"JWT"`
+}
+
+// JWTConfig configures the validation of bearer tokens, they are accepted if one of the keys is configured
+type JWTConfig struct {
+	Secret     string `yaml:"Secret" env:"SECRET"`
+	PublicKey  string `yaml:"PublicKey" env:"PUBLIC_KEY"`
+	JWKSFile   string `yaml:"JWKSFile" env:"JWKS_FILE"`
+	Issuer     string `yaml:"Issuer" env:"ISSUER"`
+	Audience   string `yaml:"Audience" env:"AUDIENCE"`
+	OwnerClaim string `yaml:"OwnerClaim" env:"OWNER_CLAIM"`
+	TeamClaim  string `yaml:"TeamClaim" env:"TEAM_CLAIM"`
+	ScopeClaim string `yaml:"ScopeClaim" env:"SCOPE_CLAIM"`
+}
+
+type passwordConfig struct {
+	MaxAttempts       int    `yaml:"MaxAttempts" env:"MAX_ATTEMPTS"`
+	MaxAttemptsPerURL int    `yaml:"MaxAttemptsPerURL" env:"MAX_ATTEMPTS_PER_URL"`
+	AttemptWindow     string `yaml:"AttemptWindow" env:"ATTEMPT_WINDOW"`
+	Lockout           string `yaml:"Lockout" env:"LOCKOUT"`
+	MaxLockout        string `yaml:"MaxLockout" env:"MAX_LOCKOUT"`
+	CookieLifetime    string `yaml:"CookieLifetime" env:"COOKIE_LIFETIME"`
 }
 
 type redisConfig struct {
@@ -28,6 +110,22 @@ type redisConfig struct {
 	WriteTimeout string `yaml:"WriteTimeout" env:"WRITE_TIMEOUT"`
 	SessionDB    string `yaml:"SessionDB" env:"SESSION_DB"`
 	SharedKey    string `yaml:"SharedKey" env:"SHARED_KEY"`
+	KeyPrefix    string `yaml:"KeyPrefix" env:"KEY_PREFIX"`
+}
+
+type boltConfig struct {
+	File          string `yaml:"File" env:"FILE"`
+	SweepInterval string `yaml:"SweepInterval" env:"SWEEP_INTERVAL"`
+}
+
+type sqlConfig struct {
+	Dialect       string `yaml:"Dialect" env:"DIALECT"`
+	DSN           string `yaml:"DSN" env:"DSN"`
+	SweepInterval string `yaml:"SweepInterval" env:"SWEEP_INTERVAL"`
+}
+
+type memoryConfig struct {
+	SweepInterval string `yaml:"SweepInterval" env:"SWEEP_INTERVAL"`
 }
 
 type LogConfig struct {
@@ -38,11 +136,55 @@ type LogConfig struct {
 // Config contains the default values
 var (
 	config = Configuration{
-		ListenAddr:      ":8080",
-		DataDir:         "data",
-		Backend:         "redis",
-		Location:        "",
-		ShortedIDLength: 4,
+		ListenAddr:                  ":8080",
+		DataDir:                     "data",
+		Backend:                     "redis",
+		Location:                    "",
+		ShortedIDLength:             4,
+		ShortedIDGenerator:          "random",
+		ShortedIDAlphabet:           "base62",
+		ShortedIDMaxLength:          12,
+		ShortedIDCollisionThreshold: 3,
+		CustomIDMaxLength:           64,
+		ReservedIDs:                 []string{"favicon.ico", "robots.txt"},
+		RedirectType:                307,
+		ExpiredRetention:            "168h",
+		NotYetActiveStatus:          403,
+		Password: passwordConfig{
+			MaxAttempts:       5,
+			MaxAttemptsPerURL: 20,
+			AttemptWindow:     "15m",
+			Lockout:           "1m",
+			MaxLockout:        "24h",
+			CookieLifetime:    "10m",
+		},
+		Visits: visitsConfig{
+			QueueSize: 10000,
+			BatchSize: 100,
+		},
+		Auth: authConfig{
+			Enabled: false,
+			JWT: JWTConfig{
+				OwnerClaim: "sub",
+				TeamClaim:  "team",
+				ScopeClaim: "scope",
+			},
+		},
+		RateLimit: rateLimitConfig{
+			Enabled:  true,
+			Create:   RateConfig{Requests: 30, Period: "1m", Burst: 10},
+			Read:     RateConfig{Requests: 120, Period: "1m", Burst: 60},
+			Redirect: RateConfig{Requests: 600, Period: "1m", Burst: 100},
+		},
+		URLPolicy: urlPolicyConfig{
+			AllowedSchemes:         []string{"http", "https"},
+			RejectPrivateAddresses: true,
+			ResolveTimeout:         "2s",
+		},
+		Chains: chainsConfig{
+			MaxDepth: 5,
+			Flatten:  true,
+		},
 		Redis: redisConfig{
 			Host:         "127.0.0.1:6379",
 			MaxRetries:   3,
@@ -51,6 +193,17 @@ var (
 			SessionDB:    "1",
 			SharedKey:    "secret",
 		},
+		Bolt: boltConfig{
+			File:          "main.db",
+			SweepInterval: "1m",
+		},
+		SQL: sqlConfig{
+			Dialect:       "sqlite3",
+			SweepInterval: "1m",
+		},
+		Memory: memoryConfig{
+			SweepInterval: "1m",
+		},
 	}
 
 	lock = new(sync.RWMutex)
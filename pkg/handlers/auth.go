@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+
+	"github.com/srelab/url-shortener/pkg/stores"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+const (
+	apiKeyHeader = "X-API-Key"
+	principalKey = "principal" // context key of the authenticated caller
+	bearerPrefix = "Bearer "
+)
+
+// principal is the authenticated caller of the api, admins may access the entries of every owner
+type principal struct {
+	subject string // the api key or the token subject, which identifies the caller in the rate limits
+	owner   string
+	team    string
+	admin   bool
+}
+
+// authorize authenticates the bearer token or the api key of the request and requires the scope,
+// it is a no-op if the authentication is disabled
+func (handler *Handler) authorize(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			if !handler.auth {
+				return next(ctx)
+			}
+
+			header := ctx.Request().Header.Get(echo.HeaderAuthorization)
+			if len(header) > len(bearerPrefix) && strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+				return handler.authorizeToken(ctx, next, header[len(bearerPrefix):], scope)
+			}
+
+			return handler.authorizeKey(ctx, next, scope)
+		}
+	}
+}
+
+// authorizeKey authenticates the api key of the request
+func (handler *Handler) authorizeKey(ctx echo.Context, next echo.HandlerFunc, scope string) error {
+	key := ctx.Request().Header.Get(apiKeyHeader)
+	if key == "" {
+		return FailureResponse(ctx, http.StatusUnauthorized, ApiErrorUnauthorized, errors.New("missing api key or bearer token"))
+	}
+
+	apiKey, err := handler.store.Authenticate(key)
+	if err != nil {
+		if errors.Cause(err) == stores.ErrInvalidAPIKey {
+			return FailureResponse(ctx, http.StatusUnauthorized, ApiErrorUnauthorized, err)
+		}
+
+		return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+	}
+
+	if !apiKey.HasScope(scope) {
+		return FailureResponse(ctx, http.StatusForbidden, ApiErrorForbidden, errors.Errorf("the api key lacks the %s scope", scope))
+	}
+
+	ctx.Set(principalKey, &principal{
+		subject: "key:" + apiKey.ID, owner: apiKey.Owner, admin: apiKey.HasScope(shared.ScopeAdmin),
+	})
+	return next(ctx)
+}
+
+// authorizeToken validates the bearer token of the request, the challenges follow RFC 6750
+func (handler *Handler) authorizeToken(ctx echo.Context, next echo.HandlerFunc, token, scope string) error {
+	if handler.tokens == nil {
+		return FailureResponse(ctx, http.StatusUnauthorized, ApiErrorTokenInvalid, errors.New("bearer tokens are not accepted"))
+	}
+
+	identity, err := handler.tokens.verify(strings.TrimSpace(token))
+	if err != nil {
+		ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		if err == errTokenExpired {
+			return FailureResponse(ctx, http.StatusUnauthorized, ApiErrorTokenExpired, err)
+		}
+
+		return FailureResponse(ctx, http.StatusUnauthorized, ApiErrorTokenInvalid, err)
+	}
+
+	if !identity.hasScope(scope) {
+		ctx.Response().Header().Set(echo.HeaderWWWAuthenticate, fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+		return FailureResponse(ctx, http.StatusForbidden, ApiErrorInsufficientScope, errors.Errorf("the bearer token lacks the %s scope", scope))
+	}
+
+	ctx.Set(principalKey, &principal{
+		subject: "token:" + identity.owner, owner: identity.owner, team: identity.team, admin: identity.hasScope(shared.ScopeAdmin),
+	})
+	return next(ctx)
+}
+
+// getPrincipal returns the authenticated caller, or nil if the authentication is disabled
+func getPrincipal(ctx echo.Context) *principal {
+	p, _ := ctx.Get(principalKey).(*principal)
+	return p
+}
+
+// callerIdentity returns the owner and the team of the entries created by the caller
+func callerIdentity(ctx echo.Context) (string, string) {
+	if p := getPrincipal(ctx); p != nil {
+		return p.owner, p.team
+	}
+
+	return "", ""
+}
+
+// visibility returns the query selecting the entries which are visible to the caller, the entries of its
+// owner and its team. Admins and every caller without authentication see every entry.
+func visibility(ctx echo.Context) shared.EntryQuery {
+	if p := getPrincipal(ctx); p != nil && !p.admin {
+		return shared.EntryQuery{Owner: p.owner, Team: p.team}
+	}
+
+	return shared.EntryQuery{}
+}
+
+// canAccess reports whether the entry is visible to the caller
+func canAccess(ctx echo.Context, entry *shared.Entry) bool {
+	return visibility(ctx).Matches(entry)
+}
@@ -3,17 +3,17 @@ package handlers
 import (
 	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"html/template"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
-	"golang.org/x/crypto/bcrypt"
-
 	"github.com/go-playground/validator"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
+	"github.com/pkg/errors"
 
 	"github.com/srelab/url-shortener/pkg/g"
 	"github.com/srelab/url-shortener/pkg/logger"
@@ -28,6 +28,18 @@ type HandlerResult struct {
 	Pagination interface{}  `json:"pagination,omitempty"`
 }
 
+type CursorPagination struct {
+	Cursor     string `json:"cursor"`
+	NextCursor string `json:"next_cursor"`
+	Limit      int    `json:"limit"`
+}
+
+type OffsetPagination struct {
+	Offset  int  `json:"offset"`
+	Limit   int  `json:"limit"`
+	HasMore bool `json:"has_more"`
+}
+
 type HandlerError struct {
 	Code    int         `json:"code,omitempty"`
 	Message string      `json:"msg,omitempty"`
@@ -39,11 +51,22 @@ var (
 	ApiErrorServiceUnavailable = HandlerError{Code: 1002, Message: "Service unavailable"}
 	ApiErrorNotFound           = HandlerError{Code: 1003, Message: "Resource not found"}
 	ApiErrorHTTPMethod         = HandlerError{Code: 1004, Message: "HTTP method is not suported for this request"}
+	ApiErrorTooManyRequests    = HandlerError{Code: 1005, Message: "Too many requests"}
 
 	ApiErrorParameter             = HandlerError{Code: 1101, Message: "Parameter error"}
 	ApiErrorResourceNotExists     = HandlerError{Code: 1102, Message: "Resource does not exists"}
 	ApiErrorResourceAlreadyExists = HandlerError{Code: 1103, Message: "Resource already exists"}
 	ApiErrorPasswordInvalid       = HandlerError{Code: 1104, Message: "Password invalid"}
+	ApiErrorResourceIDReserved    = HandlerError{Code: 1105, Message: "Resource ID is reserved"}
+	ApiErrorHashInvalid           = HandlerError{Code: 1106, Message: "Hash invalid"}
+	ApiErrorLockedOut             = HandlerError{Code: 1107, Message: "Locked out after too many failed attempts"}
+	ApiErrorUnauthorized          = HandlerError{Code: 1108, Message: "Authentication required"}
+	ApiErrorForbidden             = HandlerError{Code: 1109, Message: "Permission denied"}
+	ApiErrorTokenInvalid          = HandlerError{Code: 1110, Message: "Bearer token invalid"}
+	ApiErrorTokenExpired          = HandlerError{Code: 1111, Message: "Bearer token expired"}
+	ApiErrorInsufficientScope     = HandlerError{Code: 1112, Message: "Bearer token lacks the required scope"}
+	ApiErrorURLPolicy             = HandlerError{Code: 1113, Message: "URL rejected by the %s rule"}
+	ApiErrorRedirectChain         = HandlerError{Code: 1114, Message: "URL leads into a redirect loop or a too long redirect chain"}
 )
 
 func FailureResponse(ctx echo.Context, status int, he HandlerError, err error, v ...interface{}) error {
@@ -109,13 +132,97 @@ func (BinderWithValidation) Bind(i interface{}, ctx echo.Context) error {
 }
 
 type Handler struct {
-	store  stores.Store
-	engine *echo.Echo
+	store          stores.Store
+	engine         *echo.Echo
+	cookieLifetime time.Duration
+	expiredPage    *template.Template
+	pendingPage    *template.Template
+	auth           bool           // whether the api requires an api key or a bearer token
+	tokens         *tokenVerifier // nil if bearer tokens are not accepted
+	limits         rateLimits
+	trustedProxies []*net.IPNet // peers whose forwarded client IPs are believed
+}
+
+// parseTrustedProxies parses the IP addresses and CIDR networks of the trusted proxies
+func parseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(proxies))
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid trusted proxy '%s'", proxy)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// isTrustedProxy reports whether the IP belongs to a trusted proxy
+func (handler *Handler) isTrustedProxy(ip net.IP) bool {
+	for _, network := range handler.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// clientIP returns the IP of the client. The forwarded headers are only believed if the peer is a
+// trusted proxy, as any client can send them; X-Forwarded-For is read from the right, skipping the
+// trusted proxies, since the leftmost addresses are chosen by the client.
+func (handler *Handler) clientIP(ctx echo.Context) string {
+	peer, _, err := net.SplitHostPort(ctx.Request().RemoteAddr)
+	if err != nil {
+		peer = ctx.Request().RemoteAddr
+	}
+
+	if ip := net.ParseIP(peer); ip == nil || !handler.isTrustedProxy(ip) {
+		return peer
+	}
+
+	if forwarded := ctx.Request().Header.Get(echo.HeaderXForwardedFor); forwarded != "" {
+		client := peer
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := net.ParseIP(strings.TrimSpace(hops[i]))
+			if ip == nil {
+				break
+			}
+
+			client = ip.String()
+			if !handler.isTrustedProxy(ip) {
+				break
+			}
+		}
+
+		return client
+	}
+
+	if ip := net.ParseIP(ctx.Request().Header.Get(echo.HeaderXRealIP)); ip != nil {
+		return ip.String()
+	}
+
+	return peer
+}
+
+// isTLS reports whether the client connected with TLS, either directly or to a proxy in front
+func isTLS(ctx echo.Context) bool {
+	return ctx.Request().TLS != nil || ctx.Request().Header.Get("X-Forwarded-Proto") == "https"
 }
 
 func (handler *Handler) getURL(ctx echo.Context) string {
 	protocol := "http"
-	if ctx.Request().TLS != nil || ctx.Request().Header.Get("X-Forwarded-Proto") == "https" {
+	if isTLS(ctx) {
 		protocol = "https"
 	}
 
@@ -138,9 +245,56 @@ func (handler *Handler) getDeletionURL(ctx echo.Context, prefix string) string {
 
 // New initializes the http handlers
 func New(store stores.Store) (*Handler, error) {
+	conf := g.GetConfig().Password
+
+	if !redirectTypes[g.GetConfig().RedirectType] {
+		return nil, errors.Errorf("unsupported redirect type %d", g.GetConfig().RedirectType)
+	}
+
+	cookieLifetime, err := time.ParseDuration(conf.CookieLifetime)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse password cookie lifetime")
+	}
+
+	expiredPage, err := loadPage(g.GetConfig().ExpiredPage, defaultExpiredPage)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load the expired page")
+	}
+
+	if status := g.GetConfig().NotYetActiveStatus; status < 400 || status > 599 {
+		return nil, errors.Errorf("unsupported not yet active status %d", status)
+	}
+
+	pendingPage, err := loadPage(g.GetConfig().NotYetActivePage, defaultNotYetActivePage)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load the not yet active page")
+	}
+
+	tokens, err := newTokenVerifier(g.GetConfig().Auth.JWT)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not initialize the bearer token verification")
+	}
+
+	limits, err := newRateLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := parseTrustedProxies(g.GetConfig().TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	handler := &Handler{
-		store:  store,
-		engine: echo.New(),
+		store:          store,
+		engine:         echo.New(),
+		cookieLifetime: cookieLifetime,
+		expiredPage:    expiredPage,
+		pendingPage:    pendingPage,
+		auth:           g.GetConfig().Auth.Enabled,
+		tokens:         tokens,
+		limits:         limits,
+		trustedProxies: trustedProxies,
 	}
 
 	handler.engine.HideBanner = true
@@ -226,42 +380,29 @@ func New(store stores.Store) (*Handler, error) {
 
 	PublicHandler{Handler: handler}.Init()
 	UrlHandler{Handler: handler}.Init()
+	handler.reserveRoutes()
 
-	handler.engine.GET("*", func(ctx echo.Context) error {
-		id := ctx.Request().URL.Path[1:]
-		entry, err := handler.store.GetEntryAndIncrease(id)
-		if err != nil {
-			if strings.Contains(err.Error(), shared.ErrNoEntryFound.Error()) {
-				return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, err)
-			}
+	handler.engine.GET("*", handler.redirect, handler.rateLimit("redirect", handler.limits.redirect))
+	handler.engine.POST("*", handler.unlock, handler.rateLimit("redirect", handler.limits.redirect))
 
-			return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorResourceNotExists, err)
-		}
-
-		if len(entry.Password) == 0 {
-			go handler.RegisterVisitor(id, ctx, entry)
-			return ctx.Redirect(http.StatusTemporaryRedirect, entry.Public.URL)
-		}
-
-		payload := new(PasswordPayLoad)
-		if err := ctx.Bind(payload); err != nil {
-			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
-		}
+	return handler, nil
+}
 
-		if err := bcrypt.CompareHashAndPassword(entry.Password, []byte(payload.Password)); err != nil {
-			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorPasswordInvalid, err)
+// reserveRoutes reserves the first segment of the registered routes, so custom ids can not shadow them
+func (handler *Handler) reserveRoutes() {
+	for _, route := range handler.engine.Routes() {
+		segment := strings.SplitN(strings.TrimPrefix(route.Path, "/"), "/", 2)[0]
+		if segment != "" && !strings.ContainsAny(segment[:1], ":*") {
+			handler.store.ReserveIDs(segment)
 		}
-
-		go handler.RegisterVisitor(id, ctx, entry)
-		return ctx.Redirect(http.StatusTemporaryRedirect, entry.Public.URL)
-	})
-
-	return handler, nil
+	}
 }
 
-func (handler *Handler) RegisterVisitor(id string, ctx echo.Context, entry *shared.Entry) {
+// RegisterVisitor registers the visit of the request, the visitor is extracted before the handler returns
+// and the request context is recycled.
+func (handler *Handler) RegisterVisitor(id string, ctx echo.Context) {
 	handler.store.RegisterVisit(id, shared.Visitor{
-		IP:          ctx.RealIP(),
+		IP:          handler.clientIP(ctx),
 		Timestamp:   &shared.Datetime{Time: time.Now()},
 		Referer:     ctx.Request().Header.Get("Referer"),
 		UserAgent:   ctx.Request().Header.Get("User-Agent"),
@@ -270,7 +411,6 @@ func (handler *Handler) RegisterVisitor(id string, ctx echo.Context, entry *shar
 		UTMCampaign: ctx.QueryParam("utm_campaign"),
 		UTMContent:  ctx.QueryParam("utm_content"),
 		UTMTerm:     ctx.QueryParam("utm_term"),
-		Expiration:  entry.GetExpiration(),
 	})
 }
 
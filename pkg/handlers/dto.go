@@ -10,8 +10,42 @@ type URLPayLoad struct {
 	DeletionURL string           `json:"deletion_url"      validate:"-"`
 	Password    string           `json:"password"          validate:"-"`
 	Expiration  *shared.Datetime `json:"expiration"          validate:"-"`
+	Dedupe      *bool            `json:"dedupe,omitempty"  validate:"-"`
+	// RedirectType is the status code of the redirect, the configured default is used if omitted
+	RedirectType int `json:"redirect_type,omitempty" validate:"omitempty,in=301;302;307;308"`
+	// Interstitial shows the preview page before every redirect
+	Interstitial bool `json:"interstitial,omitempty" validate:"-"`
+	// MaxVisits limits the number of redirects, e.g. 1 for one-time links
+	MaxVisits int `json:"max_visits,omitempty" validate:"min=0"`
+	// ValidFrom activates the URL at this time, until then the not yet active response is returned
+	ValidFrom *shared.Datetime `json:"valid_from" validate:"-"`
+}
+
+type UpdatePayLoad struct {
+	URL        *string          `json:"url"        validate:"omitempty,url"`
+	Password   *string          `json:"password"   validate:"-"`
+	Expiration *shared.Datetime `json:"expiration" validate:"-"`
+	// RedirectType 0 resets the status code of the redirect to the configured default
+	RedirectType *int  `json:"redirect_type" validate:"omitempty,in=0;301;302;307;308"`
+	Interstitial *bool `json:"interstitial"  validate:"-"`
+	// MaxVisits 0 removes the limit, the visits so far keep counting against a new limit
+	MaxVisits *int `json:"max_visits" validate:"omitempty,min=0"`
+	// ValidFrom "" activates the URL immediately
+	ValidFrom *shared.Datetime `json:"valid_from" validate:"-"`
 }
 
 type PasswordPayLoad struct {
-	Password string `json:"password" validate:"required"`
+	Password string `json:"password" form:"password" validate:"required"`
+}
+
+type ListPayLoad struct {
+	Cursor string `query:"cursor" validate:"-"`
+	Limit  int    `query:"limit"  validate:"omitempty,min=1,max=1000"`
+}
+
+type VisitorsPayLoad struct {
+	Offset int              `query:"offset" validate:"min=0"`
+	Limit  int              `query:"limit"  validate:"omitempty,min=1,max=1000"`
+	From   *shared.Datetime `query:"from"   validate:"-"`
+	To     *shared.Datetime `query:"to"     validate:"-"`
 }
@@ -0,0 +1,1268 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/labstack/echo"
+
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "url-shortener")
+	if err != nil {
+		panic(err)
+	}
+
+	config := g.GetConfig()
+	config.Backend = "memory"
+	config.DataDir = filepath.Join(dir, "data")
+	config.Log.Dir = filepath.Join(dir, "log")
+	// the api keys and the rate limits are covered by their own tests
+	config.Auth.Enabled = false
+	config.RateLimit.Enabled = false
+	g.SetConfig(config)
+	logger.InitLogger()
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testResolver resolves the hosts of the map to their address and every other host to a public address
+type testResolver map[string]string
+
+func (resolver testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ip, ok := resolver[host]
+	if !ok {
+		ip = "93.184.216.34"
+	}
+
+	return []net.IPAddr{{IP: net.ParseIP(ip)}}, nil
+}
+
+// newTestHandler returns a handler backed by an empty in-memory store
+func newTestHandler(t *testing.T) *Handler {
+	t.Helper()
+
+	store, err := stores.New()
+	if err != nil {
+		t.Fatalf("could not create store: %v", err)
+	}
+
+	store.UseResolver(testResolver{"intranet.example.org": "10.1.2.3"})
+
+	handler, err := New(*store)
+	if err != nil {
+		t.Fatalf("could not create handler: %v", err)
+	}
+
+	return handler
+}
+
+// doRequest serves a request with an optional JSON body and returns the recorded response
+func doRequest(handler *Handler, method, target string, body interface{}) *httptest.ResponseRecorder {
+	return doRequestWithKey(handler, "", method, target, body)
+}
+
+// doRequestWithKey serves a request like doRequest, authenticated by the api key if given
+func doRequestWithKey(handler *Handler, key, method, target string, body interface{}) *httptest.ResponseRecorder {
+	var reader *bytes.Reader
+	if body != nil {
+		raw, _ := json.Marshal(body)
+		reader = bytes.NewReader(raw)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	req := httptest.NewRequest(method, target, reader)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+
+	if key != "" {
+		req.Header.Set(apiKeyHeader, key)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.engine.ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeResult unmarshals the response, the result is decoded into v if given
+func decodeResult(t *testing.T, rec *httptest.ResponseRecorder, v interface{}) HandlerResult {
+	t.Helper()
+
+	var raw struct {
+		HandlerResult
+		Result json.RawMessage `json:"result"`
+	}
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &raw); err != nil {
+		t.Fatalf("could not unmarshal response %q: %v", rec.Body.String(), err)
+	}
+
+	if v != nil {
+		if err := json.Unmarshal(raw.Result, v); err != nil {
+			t.Fatalf("could not unmarshal result %q: %v", raw.Result, err)
+		}
+	}
+
+	return raw.HandlerResult
+}
+
+// createEntry creates an entry through the API and returns the created payload
+func createEntry(t *testing.T, handler *Handler, payload map[string]interface{}) URLPayLoad {
+	t.Helper()
+
+	rec := doRequest(handler, http.MethodPost, prefix, payload)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d creating entry, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var created URLPayLoad
+	decodeResult(t, rec, &created)
+	return created
+}
+
+// waitForVisitors polls the visitors endpoint until the wanted number of visits is registered
+func waitForVisitors(t *testing.T, handler *Handler, id string, want int) []shared.Visitor {
+	t.Helper()
+
+	var visitors []shared.Visitor
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		visitors = nil
+
+		rec := doRequest(handler, http.MethodGet, prefix+"/"+id+"/visitors", nil)
+		decodeResult(t, rec, &visitors)
+		if len(visitors) >= want {
+			return visitors
+		}
+	}
+
+	t.Fatalf("expected %d visitors of %s, got %d", want, id, len(visitors))
+	return nil
+}
+
+func TestCreateAndLookup(t *testing.T) {
+	handler := newTestHandler(t)
+
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/some path"})
+	if len(created.ID) != g.GetConfig().ShortedIDLength {
+		t.Errorf("expected generated id of length %d, got %q", g.GetConfig().ShortedIDLength, created.ID)
+	}
+
+	if created.URL != "http://example.com/"+created.ID {
+		t.Errorf("unexpected short url %q", created.URL)
+	}
+
+	rec := doRequest(handler, http.MethodGet, prefix+"/"+created.ID+"/lookup", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var entry shared.Entry
+	decodeResult(t, rec, &entry)
+	if entry.Public.URL != "https://example.org/some%20path" {
+		t.Errorf("unexpected url %q", entry.Public.URL)
+	}
+
+	if entry.Public.CreatedOn == nil || entry.Public.CreatedOn.IsZero() {
+		t.Error("expected the creation time to be set")
+	}
+
+	rec = doRequest(handler, http.MethodGet, prefix+"/missing/lookup", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for a missing entry, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestCreateValidation(t *testing.T) {
+	handler := newTestHandler(t)
+
+	rec := doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": "not a url"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	if result := decodeResult(t, rec, nil); result.Success || result.Error.Code != ApiErrorParameter.Code {
+		t.Errorf("expected error code %d, got %+v", ApiErrorParameter.Code, result.Error)
+	}
+}
+
+func TestURLPolicy(t *testing.T) {
+	config := g.GetConfig()
+	restricted := config
+	restricted.URLPolicy.DeniedDomains = []string{"*.evil.example.org"}
+	g.SetConfig(restricted)
+	handler := newTestHandler(t)
+	g.SetConfig(config)
+
+	for _, test := range []struct {
+		url  string
+		rule string
+	}{
+		{"javascript:alert(1)", stores.RuleScheme},
+		{"file:///etc/passwd", stores.RuleScheme},
+		{"https://www.evil.example.org/", stores.RuleDeniedDomain},
+		{"http://169.254.169.254/latest/meta-data/", stores.RulePrivateAddress},
+		{"http://localhost:8080/admin", stores.RulePrivateAddress},
+		{"http://[::1]/", stores.RulePrivateAddress},
+		{"https://intranet.example.org/", stores.RulePrivateAddress},
+	} {
+		rec := doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": test.url})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for %s, got %d: %s", http.StatusBadRequest, test.url, rec.Code, rec.Body.String())
+			continue
+		}
+
+		result := decodeResult(t, rec, nil)
+		if want := fmt.Sprintf(ApiErrorURLPolicy.Message, test.rule); result.Error.Code != ApiErrorURLPolicy.Code || result.Error.Message != want {
+			t.Errorf("expected %q for %s, got %+v", want, test.url, result.Error)
+		}
+	}
+
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/"})
+	deletion, err := url.Parse(created.DeletionURL)
+	if err != nil {
+		t.Fatalf("could not parse deletion url %q: %v", created.DeletionURL, err)
+	}
+
+	rec := doRequest(handler, http.MethodPatch, deletion.Path, map[string]interface{}{"url": "http://127.0.0.1/"})
+	if result := decodeResult(t, rec, nil); rec.Code != http.StatusBadRequest || result.Error.Code != ApiErrorURLPolicy.Code {
+		t.Errorf("expected the update to be rejected by the policy, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRedirectChains(t *testing.T) {
+	config := g.GetConfig()
+	chained := config
+	chained.Chains.Hosts = []string{"example.com"}
+	g.SetConfig(chained)
+	handler := newTestHandler(t)
+	g.SetConfig(config)
+
+	first := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/final"})
+	second := createEntry(t, handler, map[string]interface{}{"url": first.URL})
+
+	rec := doRequest(handler, http.MethodGet, prefix+"/"+second.ID+"/lookup", nil)
+	var entry shared.Entry
+	if decodeResult(t, rec, &entry); entry.Public.URL != "https://example.org/final" {
+		t.Errorf("expected the chain to be flattened, got %q", entry.Public.URL)
+	}
+
+	rec = doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": "http://example.com/loop", "id": "loop"})
+	if result := decodeResult(t, rec, nil); rec.Code != http.StatusBadRequest || result.Error.Code != ApiErrorRedirectChain.Code {
+		t.Errorf("expected the self reference to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// the interstitial is kept in the chain
+	guarded := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/guarded", "interstitial": true})
+	third := createEntry(t, handler, map[string]interface{}{"url": guarded.URL})
+	rec = doRequest(handler, http.MethodGet, prefix+"/"+third.ID+"/lookup", nil)
+	if decodeResult(t, rec, &entry); entry.Public.URL != guarded.URL {
+		t.Errorf("expected the chain to end at the interstitial, got %q", entry.Public.URL)
+	}
+
+	deletion, err := url.Parse(guarded.DeletionURL)
+	if err != nil {
+		t.Fatalf("could not parse deletion url %q: %v", guarded.DeletionURL, err)
+	}
+
+	rec = doRequest(handler, http.MethodPatch, deletion.Path, map[string]interface{}{"url": third.URL})
+	if result := decodeResult(t, rec, nil); rec.Code != http.StatusBadRequest || result.Error.Code != ApiErrorRedirectChain.Code {
+		t.Errorf("expected the loop to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreateWithCustomID(t *testing.T) {
+	handler := newTestHandler(t)
+
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org", "id": "custom"})
+	if created.ID != "custom" {
+		t.Errorf("expected id %q, got %q", "custom", created.ID)
+	}
+
+	rec := doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": "https://example.net", "id": "custom"})
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a taken id, got %d", http.StatusBadRequest, rec.Code)
+	}
+
+	if result := decodeResult(t, rec, nil); result.Error.Code != ApiErrorResourceAlreadyExists.Code {
+		t.Errorf("expected error code %d, got %+v", ApiErrorResourceAlreadyExists.Code, result.Error)
+	}
+}
+
+func TestCreateWithInvalidCustomID(t *testing.T) {
+	handler := newTestHandler(t)
+
+	for _, id := range []string{"with space", "sub/path", "ümlaut", strings.Repeat("a", 65)} {
+		rec := doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": "https://example.org", "id": id})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for id %q, got %d", http.StatusBadRequest, id, rec.Code)
+			continue
+		}
+
+		if result := decodeResult(t, rec, nil); result.Error.Code != ApiErrorParameter.Code {
+			t.Errorf("expected error code %d for id %q, got %+v", ApiErrorParameter.Code, id, result.Error)
+		}
+	}
+}
+
+func TestCreateWithReservedID(t *testing.T) {
+	handler := newTestHandler(t)
+
+	for _, id := range []string{"api", "API", "favicon.ico"} {
+		rec := doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": "https://example.org", "id": id})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("expected status %d for id %q, got %d", http.StatusBadRequest, id, rec.Code)
+			continue
+		}
+
+		if result := decodeResult(t, rec, nil); result.Error.Code != ApiErrorResourceIDReserved.Code {
+			t.Errorf("expected error code %d for id %q, got %+v", ApiErrorResourceIDReserved.Code, id, result.Error)
+		}
+	}
+}
+
+func TestCreateWithCustomIDConcurrently(t *testing.T) {
+	handler := newTestHandler(t)
+
+	const workers = 10
+	codes := make(chan int, workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			url := fmt.Sprintf("https://example.org/%d", i)
+			codes <- doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": url, "id": "race"}).Code
+		}(i)
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			created++
+		case http.StatusBadRequest:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+
+	if created != 1 {
+		t.Errorf("expected exactly one entry to be created, got %d", created)
+	}
+}
+
+func TestCreateWithDedupe(t *testing.T) {
+	handler := newTestHandler(t)
+	payload := map[string]interface{}{"url": "https://example.org/long", "dedupe": true}
+
+	first := createEntry(t, handler, payload)
+	second := createEntry(t, handler, payload)
+	if second.ID != first.ID {
+		t.Errorf("expected the existing id %q, got %q", first.ID, second.ID)
+	}
+
+	if second.DeletionURL != "" {
+		t.Errorf("expected no deletion url for an existing entry, got %q", second.DeletionURL)
+	}
+
+	for _, other := range []map[string]interface{}{
+		{"url": "https://example.org/long"},
+		{"url": "https://example.org/long", "dedupe": true, "password": "secret"},
+		{"url": "https://example.org/long", "dedupe": true, "expiration": "2099-01-01 00:00:00"},
+		{"url": "https://example.org/other", "dedupe": true},
+	} {
+		if created := createEntry(t, handler, other); created.ID == first.ID {
+			t.Errorf("expected a new entry for %v, got the existing id %q", other, created.ID)
+		}
+	}
+
+	// the other variants of the URL are indexed on their own
+	if third := createEntry(t, handler, payload); third.ID != first.ID {
+		t.Errorf("expected the existing id %q after the other variants, got %q", first.ID, third.ID)
+	}
+}
+
+func TestRedirectAndVisitors(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/target"})
+
+	rec := doRequest(handler, http.MethodGet, "/"+created.ID+"?utm_source=newsletter&utm_campaign=launch", nil)
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusTemporaryRedirect, rec.Code, rec.Body.String())
+	}
+
+	if location := rec.Header().Get(echo.HeaderLocation); location != "https://example.org/target" {
+		t.Errorf("unexpected redirect location %q", location)
+	}
+
+	visitors := waitForVisitors(t, handler, created.ID, 1)
+	if visitors[0].UTMSource != "newsletter" || visitors[0].UTMCampaign != "launch" {
+		t.Errorf("expected the utm parameters of the visit, got %+v", visitors[0])
+	}
+
+	rec = doRequest(handler, http.MethodGet, prefix+"/"+created.ID+"/lookup", nil)
+
+	var entry shared.Entry
+	decodeResult(t, rec, &entry)
+	if entry.Public.VisitCount != 1 {
+		t.Errorf("expected visit count 1, got %d", entry.Public.VisitCount)
+	}
+
+	rec = doRequest(handler, http.MethodGet, "/missing", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for a missing entry, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+// postPassword posts the password form of the entry with the cookies
+func postPassword(handler *Handler, id, password string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/"+id, strings.NewReader(url.Values{"password": {password}}.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	handler.engine.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestPasswordProtectedRedirect(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/secret", "password": "letmein"})
+
+	rec := doRequest(handler, http.MethodGet, "/"+created.ID, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `type="password"`) {
+		t.Fatalf("expected the password form, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	if rec = postPassword(handler, created.ID, "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for a wrong password, got %d", http.StatusUnauthorized, rec.Code)
+	}
+
+	rec = postPassword(handler, created.ID, "letmein")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get(echo.HeaderLocation) != "https://example.org/secret" {
+		t.Fatalf("expected redirect to the target, got %d: %v", rec.Code, rec.Header())
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected an unlock cookie, got %v", cookies)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/"+created.ID, nil)
+	req.AddCookie(cookies[0])
+	rec = httptest.NewRecorder()
+	handler.engine.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected the unlock cookie to skip the password form, got %d", rec.Code)
+	}
+
+	// entries without a password are not unlocked, posting must not count as a visit
+	open := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/open", "max_visits": 1})
+	if rec = postPassword(handler, open.ID, ""); rec.Code != http.StatusMethodNotAllowed || rec.Header().Get(echo.HeaderAllow) != http.MethodGet {
+		t.Errorf("expected status %d for an entry without password, got %d: %v", http.StatusMethodNotAllowed, rec.Code, rec.Header())
+	}
+
+	if rec = doRequest(handler, http.MethodGet, "/"+open.ID, nil); rec.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected the only visit to be left, got %d", rec.Code)
+	}
+}
+
+func TestPasswordAttemptsLimit(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/secret", "password": "letmein"})
+
+	for i := 0; i < g.GetConfig().Password.MaxAttempts; i++ {
+		postPassword(handler, created.ID, "wrong")
+	}
+
+	rec := postPassword(handler, created.ID, "letmein")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d after too many attempts, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// API clients get the error code of the lockout
+	rec = doRequest(handler, http.MethodPost, "/"+created.ID, map[string]string{"password": "letmein"})
+	if result := decodeResult(t, rec, nil); rec.Code != http.StatusTooManyRequests || result.Error.Code != ApiErrorLockedOut.Code {
+		t.Errorf("expected error %d, got %d: %s", ApiErrorLockedOut.Code, rec.Code, rec.Body.String())
+	}
+}
+
+func TestParallelPasswordAttempts(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/secret", "password": "letmein"})
+
+	max := g.GetConfig().Password.MaxAttempts
+	codes := make(chan int, 4*max)
+
+	var wg sync.WaitGroup
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- postPassword(handler, created.ID, "wrong").Code
+		}()
+	}
+
+	wg.Wait()
+	close(codes)
+
+	counts := map[int]int{}
+	for code := range codes {
+		counts[code]++
+	}
+
+	if counts[http.StatusUnauthorized] > max {
+		t.Errorf("expected at most %d wrong passwords to be compared, got %d", max, counts[http.StatusUnauthorized])
+	}
+
+	if counts[http.StatusUnauthorized]+counts[http.StatusTooManyRequests] != cap(codes) {
+		t.Errorf("expected only statuses %d and %d, got %v", http.StatusUnauthorized, http.StatusTooManyRequests, counts)
+	}
+
+	if rec := postPassword(handler, created.ID, "letmein"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d after the parallel attempts, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+}
+
+func TestRedirectType(t *testing.T) {
+	handler := newTestHandler(t)
+
+	tests := []struct {
+		redirectType int
+		want         int
+	}{
+		{0, g.GetConfig().RedirectType},
+		{http.StatusMovedPermanently, http.StatusMovedPermanently},
+		{http.StatusPermanentRedirect, http.StatusPermanentRedirect},
+	}
+
+	for _, test := range tests {
+		created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org", "redirect_type": test.redirectType})
+		if rec := doRequest(handler, http.MethodGet, "/"+created.ID, nil); rec.Code != test.want {
+			t.Errorf("expected status %d for redirect type %d, got %d", test.want, test.redirectType, rec.Code)
+		}
+	}
+
+	rec := doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": "https://example.org", "redirect_type": 303})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an unsupported redirect type, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/preview"})
+
+	for _, target := range []string{"/" + created.ID + "+", "/" + created.ID + "?preview=1"} {
+		rec := doRequest(handler, http.MethodGet, target, nil)
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "https://example.org/preview") {
+			t.Errorf("expected the preview page for %s, got %d: %s", target, rec.Code, rec.Body.String())
+		}
+	}
+
+	var entry shared.EntryPublicData
+	decodeResult(t, doRequest(handler, http.MethodGet, prefix+"/"+created.ID+"/lookup", nil), &entry)
+	if entry.VisitCount != 0 {
+		t.Errorf("expected the preview not to count a visit, got %d", entry.VisitCount)
+	}
+
+	protected := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/secret", "password": "letmein"})
+	if rec := doRequest(handler, http.MethodGet, "/"+protected.ID+"+", nil); strings.Contains(rec.Body.String(), "https://example.org/secret") {
+		t.Error("expected the preview to hide the URL of a protected entry")
+	}
+
+	forced := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/forced", "interstitial": true})
+	rec := doRequest(handler, http.MethodGet, "/"+forced.ID, nil)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `href="https://example.org/forced"`) {
+		t.Errorf("expected the interstitial, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestExpiredEntry(t *testing.T) {
+	handler := newTestHandler(t)
+	expiration := time.Now().Add(-time.Hour).Format(g.DefaultTimeFormat)
+
+	rec := doRequest(handler, http.MethodPost, prefix, map[string]interface{}{"url": "https://example.org/old", "expiration": expiration})
+	if result := decodeResult(t, rec, nil); rec.Code != http.StatusBadRequest || result.Error.Code != ApiErrorParameter.Code {
+		t.Fatalf("expected an entry with a past expiration to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// the expiration has a precision of seconds, the entry expires within the next two seconds
+	soon := time.Now().Add(time.Second).Truncate(time.Second).Add(time.Second)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/old", "expiration": soon.Format(g.DefaultTimeFormat)})
+	deletion, err := url.Parse(created.DeletionURL)
+	if err != nil {
+		t.Fatalf("could not parse deletion url %q: %v", created.DeletionURL, err)
+	}
+
+	// the expiration cannot be moved into the past
+	rec = doRequest(handler, http.MethodPatch, deletion.Path, map[string]interface{}{"expiration": expiration})
+	if result := decodeResult(t, rec, nil); rec.Code != http.StatusBadRequest || result.Error.Code != ApiErrorParameter.Code {
+		t.Fatalf("expected a past expiration to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	time.Sleep(time.Until(soon) + 10*time.Millisecond)
+
+	for _, target := range []string{"/" + created.ID, "/" + created.ID + "+"} {
+		rec := doRequest(handler, http.MethodGet, target, nil)
+		if rec.Code != http.StatusGone || !strings.Contains(rec.Body.String(), "expired") {
+			t.Errorf("expected status %d for %s, got %d: %s", http.StatusGone, target, rec.Code, rec.Body.String())
+		}
+	}
+
+	var entry shared.Entry
+	decodeResult(t, doRequest(handler, http.MethodGet, prefix+"/"+created.ID+"/lookup", nil), &entry)
+	if !entry.Public.Expired {
+		t.Errorf("expected the lookup to report the entry as expired, got %+v", entry.Public)
+	}
+}
+
+func TestMaxVisits(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/once", "max_visits": 5})
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- doRequest(handler, http.MethodGet, "/"+created.ID, nil).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	redirects := 0
+	for code := range codes {
+		switch code {
+		case http.StatusTemporaryRedirect:
+			redirects++
+		case http.StatusGone:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+
+	if redirects != 5 {
+		t.Errorf("expected 5 redirects, got %d", redirects)
+	}
+
+	var entry shared.Entry
+	decodeResult(t, doRequest(handler, http.MethodGet, prefix+"/"+created.ID+"/lookup", nil), &entry)
+	if entry.Public.RemainingVisits == nil || *entry.Public.RemainingVisits != 0 {
+		t.Errorf("expected no remaining visits, got %v", entry.Public.RemainingVisits)
+	}
+}
+
+func TestValidFrom(t *testing.T) {
+	handler := newTestHandler(t)
+	validFrom := time.Now().Add(time.Hour).Format(g.DefaultTimeFormat)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/embargo", "valid_from": validFrom})
+
+	for _, target := range []string{"/" + created.ID, "/" + created.ID + "+"} {
+		rec := doRequest(handler, http.MethodGet, target, nil)
+		if rec.Code != g.GetConfig().NotYetActiveStatus || !strings.Contains(rec.Body.String(), validFrom) {
+			t.Errorf("expected the not yet active page for %s, got %d: %s", target, rec.Code, rec.Body.String())
+		}
+	}
+
+	deletion, _ := url.Parse(created.DeletionURL)
+	rec := doRequest(handler, http.MethodPatch, deletion.Path, map[string]interface{}{"valid_from": ""})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	if rec = doRequest(handler, http.MethodGet, "/"+created.ID, nil); rec.Code != http.StatusTemporaryRedirect {
+		t.Errorf("expected the entry to be active, got %d", rec.Code)
+	}
+
+	rec = doRequest(handler, http.MethodPost, prefix, map[string]interface{}{
+		"url": "https://example.org", "valid_from": "2099-01-02 00:00:00", "expiration": "2099-01-01 00:00:00",
+	})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an entry which expires before it is valid, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+// newAuthTestHandler returns a handler which requires authentication with the bearer tokens of the configuration
+func newAuthTestHandler(t *testing.T, conf g.JWTConfig) *Handler {
+	t.Helper()
+
+	config := g.GetConfig()
+	defer g.SetConfig(config)
+
+	authConfig := config
+	authConfig.Auth.Enabled = true
+	authConfig.Auth.JWT = conf
+	g.SetConfig(authConfig)
+
+	return newTestHandler(t)
+}
+
+func TestAPIKeys(t *testing.T) {
+	handler := newAuthTestHandler(t, g.GetConfig().Auth.JWT)
+
+	newKey := func(owner string, scopes ...string) string {
+		key, _, err := handler.store.CreateAPIKey(owner, scopes)
+		if err != nil {
+			t.Fatalf("could not create api key: %v", err)
+		}
+
+		return key
+	}
+
+	alice, bob := newKey("alice", shared.ScopeCreate, shared.ScopeRead), newKey("bob", shared.ScopeCreate, shared.ScopeRead)
+	reader, admin := newKey("alice", shared.ScopeRead), newKey("ops", shared.ScopeAdmin)
+	payload := map[string]interface{}{"url": "https://example.org/owned"}
+
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "nokey.secret": http.StatusUnauthorized, reader: http.StatusForbidden} {
+		if rec := doRequestWithKey(handler, key, http.MethodPost, prefix, payload); rec.Code != want {
+			t.Errorf("expected status %d creating with key %q, got %d", want, key, rec.Code)
+		}
+	}
+
+	create := func(key string) string {
+		rec := doRequestWithKey(handler, key, http.MethodPost, prefix, payload)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d creating entry, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		var created URLPayLoad
+		decodeResult(t, rec, &created)
+		return created.ID
+	}
+
+	aliceID, bobID := create(alice), create(bob)
+	if aliceID == bobID {
+		t.Fatalf("expected the entries of different owners not to be deduplicated")
+	}
+
+	for key, want := range map[string][]string{reader: {aliceID}, bob: {bobID}, admin: {aliceID, bobID}} {
+		var entries map[string]shared.Entry
+		decodeResult(t, doRequestWithKey(handler, key, http.MethodGet, prefix, nil), &entries)
+
+		if len(entries) != len(want) {
+			t.Errorf("expected entries %v, got %v", want, entries)
+		}
+
+		for _, id := range want {
+			if _, ok := entries[id]; !ok {
+				t.Errorf("expected entry %s in %v", id, entries)
+			}
+		}
+	}
+
+	for _, target := range []string{"/lookup", "/visitors"} {
+		if rec := doRequestWithKey(handler, bob, http.MethodGet, prefix+"/"+aliceID+target, nil); rec.Code != http.StatusNotFound {
+			t.Errorf("expected the entry of another owner to be hidden from %s, got %d", target, rec.Code)
+		}
+
+		if rec := doRequestWithKey(handler, admin, http.MethodGet, prefix+"/"+aliceID+target, nil); rec.Code != http.StatusOK {
+			t.Errorf("expected the admin to access %s of every entry, got %d", target, rec.Code)
+		}
+	}
+
+	var entry shared.Entry
+	decodeResult(t, doRequestWithKey(handler, alice, http.MethodGet, prefix+"/"+aliceID+"/lookup", nil), &entry)
+	if entry.Owner != "alice" {
+		t.Errorf("expected the owner alice, got %q", entry.Owner)
+	}
+}
+
+func TestBearerTokens(t *testing.T) {
+	conf := g.GetConfig().Auth.JWT
+	conf.Secret, conf.Issuer, conf.Audience = "secret", "https://idp.example.org", "shortener"
+	handler := newAuthTestHandler(t, conf)
+
+	sign := func(claims jwt.MapClaims) string {
+		claims["iss"], claims["aud"] = "https://idp.example.org", []string{"shortener", "other"}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatalf("could not sign token: %v", err)
+		}
+
+		return token
+	}
+
+	request := func(token, method, target string, body interface{}) *httptest.ResponseRecorder {
+		raw, _ := json.Marshal(body)
+		req := httptest.NewRequest(method, target, bytes.NewReader(raw))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+
+		rec := httptest.NewRecorder()
+		handler.engine.ServeHTTP(rec, req)
+		return rec
+	}
+
+	exp := time.Now().Add(time.Hour).Unix()
+	alice := sign(jwt.MapClaims{"sub": "alice", "team": "blue", "scope": "create read", "exp": exp})
+	bob := sign(jwt.MapClaims{"sub": "bob", "team": "blue", "scope": []string{"read"}, "exp": exp})
+	carol := sign(jwt.MapClaims{"sub": "carol", "scope": "read", "exp": exp})
+	payload := map[string]interface{}{"url": "https://example.org/token"}
+
+	rec := request(alice, http.MethodPost, prefix, payload)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d creating entry, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var created URLPayLoad
+	decodeResult(t, rec, &created)
+
+	var entry shared.Entry
+	decodeResult(t, request(bob, http.MethodGet, prefix+"/"+created.ID+"/lookup", nil), &entry)
+	if entry.Owner != "alice" || entry.Team != "blue" {
+		t.Errorf("expected the team member to see the entry of alice in team blue, got %+v", entry)
+	}
+
+	if rec := request(carol, http.MethodGet, prefix+"/"+created.ID+"/lookup", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the entry to be hidden from other teams, got %d", rec.Code)
+	}
+
+	failures := []struct {
+		token  string
+		status int
+		code   int
+	}{
+		{"malformed", http.StatusUnauthorized, ApiErrorTokenInvalid.Code},
+		{sign(jwt.MapClaims{"sub": "alice", "scope": "create", "exp": time.Now().Add(-time.Minute).Unix()}), http.StatusUnauthorized, ApiErrorTokenExpired.Code},
+		{sign(jwt.MapClaims{"scope": "create"}), http.StatusUnauthorized, ApiErrorTokenInvalid.Code},
+		{bob, http.StatusForbidden, ApiErrorInsufficientScope.Code},
+	}
+
+	for _, failure := range failures {
+		rec := request(failure.token, http.MethodPost, prefix, payload)
+		if result := decodeResult(t, rec, nil); rec.Code != failure.status || result.Error.Code != failure.code {
+			t.Errorf("expected status %d with code %d, got %d: %s", failure.status, failure.code, rec.Code, rec.Body.String())
+		}
+
+		if rec.Header().Get(echo.HeaderWWWAuthenticate) == "" {
+			t.Errorf("expected a bearer challenge, got %v", rec.Header())
+		}
+	}
+
+	foreign := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "alice", "scope": "create", "iss": "https://evil.example.org", "aud": "shortener"})
+	token, _ := foreign.SignedString([]byte("secret"))
+	if rec := request(token, http.MethodPost, prefix, payload); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the token of another issuer to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestBearerTokensWithJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA", "kid": "key-1", "use": "sig",
+		"n": encode(key.N.Bytes()), "e": encode(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+
+	file := filepath.Join(g.GetConfig().DataDir, "jwks.json")
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatalf("could not create data dir: %v", err)
+	}
+
+	if err := ioutil.WriteFile(file, jwks, 0644); err != nil {
+		t.Fatalf("could not write jwks: %v", err)
+	}
+
+	conf := g.GetConfig().Auth.JWT
+	conf.JWKSFile = file
+	handler := newAuthTestHandler(t, conf)
+
+	for kid, want := range map[string]int{"key-1": http.StatusOK, "key-2": http.StatusUnauthorized} {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "alice", "scope": "read"})
+		token.Header["kid"] = kid
+
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("could not sign token: %v", err)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, prefix, nil)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+signed)
+		rec := httptest.NewRecorder()
+		handler.engine.ServeHTTP(rec, req)
+
+		if rec.Code != want {
+			t.Errorf("expected status %d for the key id %s, got %d: %s", want, kid, rec.Code, rec.Body.String())
+		}
+	}
+
+	// the public key must not be accepted as the secret of a HMAC
+	forged, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "mallory", "scope": "read"}).SignedString(key.N.Bytes())
+	req := httptest.NewRequest(http.MethodGet, prefix, nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+forged)
+	rec := httptest.NewRecorder()
+	handler.engine.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the forged token to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	config := g.GetConfig()
+	limited := config
+	limited.RateLimit.Enabled = true
+	limited.RateLimit.Create = g.RateConfig{Requests: 2, Period: "1h"}
+	limited.RateLimit.Redirect = g.RateConfig{Requests: 1, Period: "1h"}
+	g.SetConfig(limited)
+	handler := newTestHandler(t)
+	g.SetConfig(config)
+
+	payload := map[string]interface{}{"url": "https://example.org/limited"}
+	var created URLPayLoad
+	for i := 0; i < 2; i++ {
+		rec := doRequest(handler, http.MethodPost, prefix, payload)
+		if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Remaining") != strconv.Itoa(1-i) {
+			t.Fatalf("expected request %d to be allowed, got %d: %v", i, rec.Code, rec.Header())
+		}
+
+		decodeResult(t, rec, &created)
+	}
+
+	rec := doRequest(handler, http.MethodPost, prefix, payload)
+	if result := decodeResult(t, rec, nil); rec.Code != http.StatusTooManyRequests || result.Error.Code != ApiErrorTooManyRequests.Code {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusTooManyRequests, rec.Code, rec.Body.String())
+	}
+
+	if rec.Header().Get("Retry-After") != "1800" || rec.Header().Get("RateLimit-Limit") != "2" {
+		t.Errorf("expected the rate limit headers, got %v", rec.Header())
+	}
+
+	// every client has its own bucket, the forwarded IPs of untrusted peers are ignored
+	for _, test := range []struct {
+		remoteAddr string
+		want       int
+	}{{"192.0.2.1:1234", http.StatusTooManyRequests}, {"198.51.100.7:1234", http.StatusOK}} {
+		req := httptest.NewRequest(http.MethodPost, prefix, strings.NewReader(`{"url": "https://example.org/limited"}`))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderXRealIP, "203.0.113.9")
+		req.RemoteAddr = test.remoteAddr
+		rec = httptest.NewRecorder()
+		handler.engine.ServeHTTP(rec, req)
+
+		if rec.Code != test.want {
+			t.Errorf("expected status %d for the client %s, got %d", test.want, test.remoteAddr, rec.Code)
+		}
+	}
+
+	// the changes by the deletion URL are limited like the creations
+	deletion, _ := url.Parse(created.DeletionURL)
+	for _, method := range []string{http.MethodPatch, http.MethodDelete} {
+		if rec := doRequest(handler, method, deletion.Path, map[string]interface{}{"url": "https://example.org/changed"}); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status %d for %s, got %d", http.StatusTooManyRequests, method, rec.Code)
+		}
+	}
+
+	for i, want := range []int{http.StatusNotFound, http.StatusTooManyRequests} {
+		if rec := doRequest(handler, http.MethodGet, "/missing", nil); rec.Code != want {
+			t.Errorf("expected status %d for redirect %d, got %d", want, i, rec.Code)
+		}
+	}
+}
+
+func TestRateLimitInvalidKeys(t *testing.T) {
+	config := g.GetConfig()
+	limited := config
+	limited.RateLimit.Enabled = true
+	limited.RateLimit.Read = g.RateConfig{Requests: 2, Period: "1h"}
+	g.SetConfig(limited)
+	handler := newAuthTestHandler(t, config.Auth.JWT)
+	g.SetConfig(config)
+
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if rec := doRequestWithKey(handler, "invalid", http.MethodGet, prefix, nil); rec.Code != want {
+			t.Errorf("expected status %d for request %d with an invalid key, got %d", want, i, rec.Code)
+		}
+	}
+}
+
+func TestVisitorsPagination(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org"})
+
+	start := time.Date(2019, 1, 1, 12, 0, 0, 0, time.Local)
+	for i := 0; i < 5; i++ {
+		handler.store.RegisterVisit(created.ID, shared.Visitor{
+			IP:        fmt.Sprintf("10.0.0.%d", i),
+			Timestamp: &shared.Datetime{Time: start.Add(time.Duration(i) * time.Hour)},
+		})
+	}
+	waitForVisitors(t, handler, created.ID, 5)
+
+	tests := []struct {
+		query   string
+		ips     []string
+		hasMore bool
+	}{
+		{"", []string{"10.0.0.4", "10.0.0.3", "10.0.0.2", "10.0.0.1", "10.0.0.0"}, false},
+		{"offset=1&limit=2", []string{"10.0.0.3", "10.0.0.2"}, true},
+		{"offset=3&limit=2", []string{"10.0.0.1", "10.0.0.0"}, false},
+		{"from=" + url.QueryEscape("2019-01-01 13:00:00") + "&to=" + url.QueryEscape("2019-01-01 15:00:00"), []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"}, false},
+		{"from=" + url.QueryEscape("2019-01-01 13:00:00") + "&limit=1&offset=1", []string{"10.0.0.3"}, true},
+	}
+
+	for _, test := range tests {
+		rec := doRequest(handler, http.MethodGet, prefix+"/"+created.ID+"/visitors?"+test.query, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d: %s", test.query, http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		var visitors []shared.Visitor
+		result := decodeResult(t, rec, &visitors)
+
+		var ips []string
+		for _, visitor := range visitors {
+			ips = append(ips, visitor.IP)
+		}
+
+		if fmt.Sprint(ips) != fmt.Sprint(test.ips) {
+			t.Errorf("%s: expected visitors %v, got %v", test.query, test.ips, ips)
+		}
+
+		if hasMore := result.Pagination.(map[string]interface{})["has_more"]; hasMore != test.hasMore {
+			t.Errorf("%s: expected has_more %v, got %v", test.query, test.hasMore, hasMore)
+		}
+	}
+
+	rec := doRequest(handler, http.MethodGet, prefix+"/"+created.ID+"/visitors?from=yesterday", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for an invalid time, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestListEntries(t *testing.T) {
+	handler := newTestHandler(t)
+	createEntry(t, handler, map[string]interface{}{"url": "https://example.org/a", "id": "a"})
+	createEntry(t, handler, map[string]interface{}{"url": "https://example.org/b", "id": "b"})
+
+	rec := doRequest(handler, http.MethodGet, prefix, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	var entries map[string]shared.Entry
+	decodeResult(t, rec, &entries)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+
+	if entries["b"].Public.URL != "https://example.org/b" || entries["b"].DeletionURL == "" {
+		t.Errorf("unexpected entry %+v", entries["b"])
+	}
+}
+
+func TestListEntriesPagination(t *testing.T) {
+	handler := newTestHandler(t)
+	for _, id := range []string{"a", "b", "c"} {
+		createEntry(t, handler, map[string]interface{}{"url": "https://example.org/" + id, "id": id})
+	}
+
+	var (
+		seen   = map[string]bool{}
+		cursor = ""
+	)
+
+	for page := 0; page < 3; page++ {
+		rec := doRequest(handler, http.MethodGet, prefix+"?limit=2&cursor="+url.QueryEscape(cursor), nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+		}
+
+		var entries map[string]shared.Entry
+		result := decodeResult(t, rec, &entries)
+		if len(entries) > 2 {
+			t.Fatalf("expected at most 2 entries per page, got %d", len(entries))
+		}
+
+		for id := range entries {
+			if seen[id] {
+				t.Errorf("entry %q was listed twice", id)
+			}
+			seen[id] = true
+		}
+
+		pagination := result.Pagination.(map[string]interface{})
+		if pagination["limit"] != float64(2) {
+			t.Errorf("expected limit 2 in pagination, got %v", pagination["limit"])
+		}
+
+		if cursor = pagination["next_cursor"].(string); cursor == "" {
+			break
+		}
+	}
+
+	if cursor != "" || len(seen) != 3 {
+		t.Errorf("expected all 3 entries on complete pages, got %v (next cursor %q)", seen, cursor)
+	}
+
+	rec := doRequest(handler, http.MethodGet, prefix+"?limit=5000", nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a too large limit, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/typo", "expiration": "2099-01-01 00:00:00"})
+	handler.store.RegisterVisit(created.ID, shared.Visitor{IP: "10.0.0.1", Timestamp: &shared.Datetime{Time: time.Now()}})
+	waitForVisitors(t, handler, created.ID, 1)
+
+	deletion, err := url.Parse(created.DeletionURL)
+	if err != nil {
+		t.Fatalf("could not parse deletion url %q: %v", created.DeletionURL, err)
+	}
+
+	rec := doRequest(handler, http.MethodPatch, prefix+"/"+created.ID+"/invalid", map[string]interface{}{"url": "https://example.org/evil"})
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected status %d for an invalid hash, got %d", http.StatusForbidden, rec.Code)
+	}
+
+	rec = doRequest(handler, http.MethodPatch, deletion.Path, map[string]interface{}{"url": "https://example.org/fixed", "expiration": ""})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	var updated shared.EntryPublicData
+	decodeResult(t, rec, &updated)
+
+	if updated.URL != "https://example.org/fixed" || updated.Expiration != nil {
+		t.Errorf("unexpected updated entry %+v", updated)
+	}
+
+	if updated.VisitCount != 1 {
+		t.Errorf("expected the visits to be kept, got visit count %d", updated.VisitCount)
+	}
+
+	rec = doRequest(handler, http.MethodGet, "/"+created.ID, nil)
+	if location := rec.Header().Get(echo.HeaderLocation); location != "https://example.org/fixed" {
+		t.Errorf("expected redirect to the updated url, got %q", location)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org"})
+
+	deletion, err := url.Parse(created.DeletionURL)
+	if err != nil {
+		t.Fatalf("could not parse deletion url %q: %v", created.DeletionURL, err)
+	}
+
+	rec := doRequest(handler, http.MethodDelete, prefix+"/"+created.ID+"/invalid", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for an invalid hash, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	rec = doRequest(handler, http.MethodDelete, deletion.Path, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusOK, rec.Code, rec.Body.String())
+	}
+
+	rec = doRequest(handler, http.MethodGet, prefix+"/"+created.ID+"/lookup", nil)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status %d after deletion, got %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestVisitorIP(t *testing.T) {
+	handler := newTestHandler(t)
+	created := createEntry(t, handler, map[string]interface{}{"url": "https://example.org/target"})
+
+	// the forwarded IP of an untrusted peer is ignored
+	req := httptest.NewRequest(http.MethodGet, "/"+created.ID, nil)
+	req.Header.Set(echo.HeaderXForwardedFor, "198.51.100.1")
+	handler.engine.ServeHTTP(httptest.NewRecorder(), req)
+
+	if visitors := waitForVisitors(t, handler, created.ID, 1); visitors[0].IP != "192.0.2.1" {
+		t.Errorf("expected the visitor IP of the peer, got %s", visitors[0].IP)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	handler := newTestHandler(t)
+
+	var err error
+	if handler.trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.7"}); err != nil {
+		t.Fatalf("could not parse trusted proxies: %v", err)
+	}
+
+	for _, test := range []struct {
+		remoteAddr string
+		forwarded  string
+		realIP     string
+		want       string
+	}{
+		{remoteAddr: "203.0.113.5:1234", forwarded: "198.51.100.1", want: "203.0.113.5"},
+		{remoteAddr: "203.0.113.5:1234", realIP: "198.51.100.1", want: "203.0.113.5"},
+		{remoteAddr: "10.1.2.3:1234", want: "10.1.2.3"},
+		{remoteAddr: "10.1.2.3:1234", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{remoteAddr: "10.1.2.3:1234", forwarded: "198.51.100.1", want: "198.51.100.1"},
+		{remoteAddr: "10.1.2.3:1234", forwarded: "1.2.3.4, 198.51.100.1, 192.0.2.7", want: "198.51.100.1"},
+		{remoteAddr: "10.1.2.3:1234", forwarded: "garbage, 10.9.9.9", want: "10.9.9.9"},
+		{remoteAddr: "192.0.2.8:1234", forwarded: "198.51.100.1", want: "192.0.2.8"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if test.forwarded != "" {
+			req.Header.Set(echo.HeaderXForwardedFor, test.forwarded)
+		}
+		if test.realIP != "" {
+			req.Header.Set(echo.HeaderXRealIP, test.realIP)
+		}
+
+		if ip := handler.clientIP(handler.engine.NewContext(req, httptest.NewRecorder())); ip != test.want {
+			t.Errorf("expected client IP %s for %+v, got %s", test.want, test, ip)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"proxy.example.org"}); err == nil {
+		t.Error("expected a host name to be rejected as trusted proxy")
+	}
+}
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/pkg/errors"
+
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// errTokenExpired is returned when the bearer token has expired
+var errTokenExpired = errors.New("the bearer token has expired")
+
+// tokenVerifier validates the bearer tokens of the api, the tokens are signed with a single
+// key or with one of the keys of a JWKS, which is selected by the key id of the token
+type tokenVerifier struct {
+	key      interface{}            // []byte for HMAC, *rsa.PublicKey or *ecdsa.PublicKey
+	keys     map[string]interface{} // keys of the JWKS by their key id
+	issuer   string
+	audience string
+
+	ownerClaim string
+	teamClaim  string
+	scopeClaim string
+}
+
+// tokenIdentity is the identity the claims of a valid token are mapped to
+type tokenIdentity struct {
+	owner  string
+	team   string
+	scopes []string
+}
+
+// newTokenVerifier returns the verifier of the configured keys, or nil if no key is configured
+func newTokenVerifier(conf g.JWTConfig) (*tokenVerifier, error) {
+	verifier := &tokenVerifier{
+		issuer:     conf.Issuer,
+		audience:   conf.Audience,
+		ownerClaim: conf.OwnerClaim,
+		teamClaim:  conf.TeamClaim,
+		scopeClaim: conf.ScopeClaim,
+	}
+
+	configured := 0
+	for _, value := range []string{conf.Secret, conf.PublicKey, conf.JWKSFile} {
+		if value != "" {
+			configured++
+		}
+	}
+
+	switch {
+	case configured == 0:
+		return nil, nil
+	case configured > 1:
+		return nil, errors.New("only one of the jwt secret, public key and jwks file can be configured")
+	case conf.Secret != "":
+		verifier.key = []byte(conf.Secret)
+	case conf.PublicKey != "":
+		raw, err := ioutil.ReadFile(conf.PublicKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read the jwt public key")
+		}
+
+		if verifier.key, err = parsePublicKey(raw); err != nil {
+			return nil, err
+		}
+	default:
+		raw, err := ioutil.ReadFile(conf.JWKSFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read the jwks file")
+		}
+
+		if verifier.keys, err = parseJWKS(raw); err != nil {
+			return nil, err
+		}
+	}
+
+	if verifier.ownerClaim == "" {
+		return nil, errors.New("the jwt owner claim is required")
+	}
+
+	return verifier, nil
+}
+
+// parsePublicKey parses a PEM encoded RSA or ECDSA public key
+func parsePublicKey(raw []byte) (interface{}, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(raw); err == nil {
+		return key, nil
+	}
+
+	key, err := jwt.ParseECPublicKeyFromPEM(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "the jwt public key is no PEM encoded RSA or ECDSA public key")
+	}
+
+	return key, nil
+}
+
+// jwk is a JSON web key, see RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	K   string `json:"k"`   // secret of symmetric keys
+	N   string `json:"n"`   // modulus of RSA keys
+	E   string `json:"e"`   // exponent of RSA keys
+	Crv string `json:"crv"` // curve of EC keys
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS parses the signing keys of a JWKS by their key id
+func parseJWKS(raw []byte) (map[string]interface{}, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(raw, &jwks); err != nil {
+		return nil, errors.Wrap(err, "could not parse the jwks")
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not parse the jwk '%s'", k.Kid)
+		}
+
+		keys[k.Kid] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("the jwks contains no signing keys")
+	}
+
+	return keys, nil
+}
+
+// publicKey returns the key which verifies the signatures
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "oct":
+		return decodeSegment(k.K)
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.Errorf("unsupported curve '%s'", k.Crv)
+		}
+
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+
+	return nil, errors.Errorf("unsupported key type '%s'", k.Kty)
+}
+
+// decodeSegment decodes a base64url value of a jwk
+func decodeSegment(value string) ([]byte, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	return raw, errors.Wrap(err, "could not decode jwk value")
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer of a jwk
+func decodeBigInt(value string) (*big.Int, error) {
+	raw, err := decodeSegment(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(raw), nil
+}
+
+// verify validates the token and maps its claims to an identity
+func (verifier *tokenVerifier) verify(raw string) (*tokenIdentity, error) {
+	claims := jwt.MapClaims{}
+	if _, err := jwt.ParseWithClaims(raw, claims, verifier.keyFunc); err != nil {
+		if ve, ok := err.(*jwt.ValidationError); ok && ve.Errors&jwt.ValidationErrorExpired != 0 {
+			return nil, errTokenExpired
+		}
+
+		return nil, errors.Wrap(err, "invalid bearer token")
+	}
+
+	if verifier.issuer != "" && !claims.VerifyIssuer(verifier.issuer, true) {
+		return nil, errors.New("the bearer token was issued by another issuer")
+	}
+
+	if verifier.audience != "" && !hasAudience(claims, verifier.audience) {
+		return nil, errors.New("the bearer token is meant for another audience")
+	}
+
+	identity := &tokenIdentity{scopes: claimValues(claims[verifier.scopeClaim])}
+	identity.owner, _ = claims[verifier.ownerClaim].(string)
+	if identity.owner == "" {
+		return nil, errors.Errorf("the bearer token has no '%s' claim", verifier.ownerClaim)
+	}
+
+	if verifier.teamClaim != "" {
+		identity.team, _ = claims[verifier.teamClaim].(string)
+	}
+
+	return identity, nil
+}
+
+// keyFunc returns the key which verifies the token. The signing method of the token must fit the
+// type of the key, e.g. a public key must never be used as the secret of a HMAC.
+func (verifier *tokenVerifier) keyFunc(token *jwt.Token) (interface{}, error) {
+	key := verifier.key
+	if verifier.keys != nil {
+		kid, _ := token.Header["kid"].(string)
+
+		var ok bool
+		if key, ok = verifier.keys[kid]; !ok && kid == "" && len(verifier.keys) == 1 {
+			// a JWKS with a single key is used for the tokens without a key id
+			for _, key = range verifier.keys {
+				ok = true
+			}
+		}
+
+		if !ok {
+			return nil, errors.Errorf("unknown key id '%s'", kid)
+		}
+	}
+
+	var ok bool
+	switch key.(type) {
+	case []byte:
+		_, ok = token.Method.(*jwt.SigningMethodHMAC)
+	case *rsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodRSA)
+		if !ok {
+			_, ok = token.Method.(*jwt.SigningMethodRSAPSS)
+		}
+	case *ecdsa.PublicKey:
+		_, ok = token.Method.(*jwt.SigningMethodECDSA)
+	}
+
+	if !ok {
+		return nil, errors.Errorf("unexpected signing method '%v'", token.Header["alg"])
+	}
+
+	return key, nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list of strings, contains the audience
+func hasAudience(claims jwt.MapClaims, audience string) bool {
+	for _, aud := range claimValues(claims["aud"]) {
+		if aud == audience {
+			return true
+		}
+	}
+
+	return false
+}
+
+// claimValues returns the values of a claim, which is either a list of strings or a space separated string
+func claimValues(claim interface{}) []string {
+	switch claim := claim.(type) {
+	case string:
+		return strings.Fields(claim)
+	case []interface{}:
+		values := make([]string, 0, len(claim))
+		for _, value := range claim {
+			if value, ok := value.(string); ok {
+				values = append(values, value)
+			}
+		}
+
+		return values
+	}
+
+	return nil
+}
+
+// hasScope reports whether the token grants the scope
+func (identity *tokenIdentity) hasScope(scope string) bool {
+	return shared.HasScope(identity.scopes, scope)
+}
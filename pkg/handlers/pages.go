@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/labstack/echo"
+
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// passwordPage asks for the password of a protected entry, the form is posted to the URL of the page
+var passwordPage = template.Must(template.New("password").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex">
+	<title>Password required</title>
+</head>
+<body>
+	<form method="post">
+		<p>This link is protected by a password.</p>
+		{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+		<input type="password" name="password" placeholder="Password" autofocus required>
+		<button type="submit">Continue</button>
+	</form>
+</body>
+</html>
+`))
+
+// passwordPageData is rendered into the password page
+type passwordPageData struct {
+	Error string
+}
+
+// previewPage shows the details of an entry before it is visited, the URL of protected entries is hidden
+var previewPage = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex">
+	<meta name="referrer" content="no-referrer">
+	<title>Link preview</title>
+</head>
+<body>
+	<p>This link leads to:</p>
+	{{if .Protected}}<p><em>The destination is protected by a password.</em></p>{{else}}<p><strong>{{.URL}}</strong></p>{{end}}
+	<dl>
+		<dt>Created</dt><dd>{{.CreatedOn}}</dd>
+		<dt>Visits</dt><dd>{{.VisitCount}}</dd>
+		{{if .Expiration}}<dt>Expires</dt><dd>{{.Expiration}}</dd>{{end}}
+	</dl>
+	<p><a href="{{.ContinueURL}}" rel="noreferrer">Continue</a></p>
+</body>
+</html>
+`))
+
+// previewPageData is rendered into the preview page
+type previewPageData struct {
+	URL         string
+	Protected   bool
+	CreatedOn   string
+	VisitCount  int
+	Expiration  string
+	ContinueURL string
+}
+
+// newPreviewPageData returns the page data of the entry, continuing to the given URL
+func newPreviewPageData(entry *shared.Entry, continueURL string) previewPageData {
+	data := previewPageData{
+		URL:         entry.Public.URL,
+		Protected:   len(entry.Password) != 0,
+		VisitCount:  entry.Public.VisitCount,
+		ContinueURL: continueURL,
+	}
+
+	if entry.Public.CreatedOn != nil {
+		data.CreatedOn = entry.Public.CreatedOn.Format(g.DefaultTimeFormat)
+	}
+
+	if entry.Public.Expiration != nil && !entry.Public.Expiration.IsZero() {
+		data.Expiration = entry.Public.Expiration.Format(g.DefaultTimeFormat)
+	}
+
+	return data
+}
+
+// defaultExpiredPage tells the visitors of an expired entry that the link is gone, see the ExpiredPage option
+var defaultExpiredPage = template.Must(template.New("expired").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex">
+	<title>Link expired</title>
+</head>
+<body>
+	<p>This link has expired{{if .Expiration}} on {{.Expiration}}{{end}} and is no longer available.</p>
+</body>
+</html>
+`))
+
+// expiredPageData is rendered into the expired page
+type expiredPageData struct {
+	ID         string
+	Expiration string
+}
+
+// defaultNotYetActivePage tells the visitors of an entry before its valid from time when it becomes active,
+// see the NotYetActivePage option
+var defaultNotYetActivePage = template.Must(template.New("notyetactive").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<meta name="viewport" content="width=device-width, initial-scale=1">
+	<meta name="robots" content="noindex">
+	<title>Link not yet active</title>
+</head>
+<body>
+	<p>This link is not active yet, please come back on {{.ValidFrom}}.</p>
+</body>
+</html>
+`))
+
+// notYetActivePageData is rendered into the not yet active page
+type notYetActivePageData struct {
+	ID        string
+	ValidFrom string
+}
+
+// loadPage parses the configured page, the built-in page is used if none is configured
+func loadPage(file string, builtin *template.Template) (*template.Template, error) {
+	if file == "" {
+		return builtin, nil
+	}
+
+	return template.ParseFiles(file)
+}
+
+// renderPage renders the page with the data, pages are never cached
+func renderPage(ctx echo.Context, status int, page *template.Template, data interface{}) error {
+	var buf bytes.Buffer
+	if err := page.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	ctx.Response().Header().Set("Cache-Control", "no-store")
+	return ctx.HTMLBlob(status, buf.Bytes())
+}
@@ -6,6 +6,7 @@ import (
 	"strings"
 
 	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/stores"
 
 	"github.com/labstack/echo"
 )
@@ -19,6 +20,7 @@ func (handler PublicHandler) Init() {
 	group.GET("/", handler.get)
 	group.GET("/info", handler.info)
 	group.GET("/health", handler.info)
+	group.GET("/metrics", handler.metrics)
 }
 
 func (PublicHandler) get(ctx echo.Context) error {
@@ -41,3 +43,11 @@ func (handler *Handler) health(ctx echo.Context) error {
 		},
 	})
 }
+
+func (handler *Handler) metrics(ctx echo.Context) error {
+	return SuccessResponse(ctx, http.StatusOK, &HandlerResult{
+		Result: map[string]interface{}{
+			"visits": stores.VisitMetrics(),
+		},
+	})
+}
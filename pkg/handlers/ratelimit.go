@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// rateLimits are the rate limits of the kinds of requests, the zero rate limit allows every request
+type rateLimits struct {
+	create   shared.RateLimit
+	read     shared.RateLimit
+	redirect shared.RateLimit
+}
+
+// newRateLimits parses the configured rate limits
+func newRateLimits() (rateLimits, error) {
+	var limits rateLimits
+
+	conf := g.GetConfig().RateLimit
+	if !conf.Enabled {
+		return limits, nil
+	}
+
+	for _, limit := range []struct {
+		name  string
+		conf  g.RateConfig
+		limit *shared.RateLimit
+	}{
+		{"create", conf.Create, &limits.create},
+		{"read", conf.Read, &limits.read},
+		{"redirect", conf.Redirect, &limits.redirect},
+	} {
+		if limit.conf.Requests <= 0 {
+			continue
+		}
+
+		period, err := time.ParseDuration(limit.conf.Period)
+		if err != nil || period <= 0 {
+			return limits, errors.Errorf("invalid period '%s' of the %s rate limit", limit.conf.Period, limit.name)
+		}
+
+		burst := limit.conf.Burst
+		if burst <= 0 {
+			burst = limit.conf.Requests
+		}
+
+		*limit.limit = shared.RateLimit{Rate: float64(limit.conf.Requests) / period.Seconds(), Burst: burst}
+	}
+
+	return limits, nil
+}
+
+// rateLimit limits the requests of every client with a token bucket. Authenticated clients are identified by
+// their api key or token subject, so the middleware must follow authorize, all others by their IP.
+func (handler *Handler) rateLimit(name string, limit shared.RateLimit) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		if limit.Rate <= 0 {
+			return next
+		}
+
+		return func(ctx echo.Context) error {
+			result, err := handler.store.TakeToken(name+":"+handler.rateLimitSubject(ctx), limit)
+			if err != nil {
+				// the requests are allowed while the rate limits are unavailable
+				logger.Warnf("could not apply the %s rate limit: %v", name, err)
+				return next(ctx)
+			}
+
+			header := ctx.Response().Header()
+			header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+			header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			header.Set("RateLimit-Reset", ceilSeconds(result.Reset))
+
+			if !result.Allowed {
+				header.Set("Retry-After", ceilSeconds(result.RetryAfter))
+				return FailureResponse(ctx, http.StatusTooManyRequests, ApiErrorTooManyRequests, errors.Errorf("the %s rate limit is exceeded", name))
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+// limitClient limits the requests of every client IP ahead of authorize, so invalid api keys and tokens are
+// limited before they are looked up. Without authentication rateLimit limits the client IPs already.
+func (handler *Handler) limitClient(name string, limit shared.RateLimit) echo.MiddlewareFunc {
+	if !handler.auth {
+		return func(next echo.HandlerFunc) echo.HandlerFunc {
+			return next
+		}
+	}
+
+	return handler.rateLimit(name, limit)
+}
+
+// rateLimitSubject returns the key of the client in the token buckets
+func (handler *Handler) rateLimitSubject(ctx echo.Context) string {
+	if p := getPrincipal(ctx); p != nil {
+		return p.subject
+	}
+
+	return "ip:" + handler.clientIP(ctx)
+}
+
+// ceilSeconds formats the duration as whole seconds, rounded up
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
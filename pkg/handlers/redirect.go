@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+	"github.com/srelab/url-shortener/pkg/util"
+)
+
+const (
+	// unlockCookiePrefix is the name prefix of the cookies which keep a protected entry unlocked
+	unlockCookiePrefix = "unlock_"
+
+	// previewSuffix appended to an id shows the preview page instead of redirecting
+	previewSuffix = "+"
+)
+
+// redirect redirects to the URL of the entry, protected entries render the password page first
+func (handler *Handler) redirect(ctx echo.Context) error {
+	id := ctx.Request().URL.Path[1:]
+	if strings.HasSuffix(id, previewSuffix) || ctx.QueryParam("preview") == "1" {
+		return handler.preview(ctx, strings.TrimSuffix(id, previewSuffix))
+	}
+
+	entry, err := handler.store.GetEntryByID(id)
+	if err != nil {
+		if errors.Cause(err) == shared.ErrNoEntryFound {
+			return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, err)
+		}
+
+		return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+	}
+
+	if isGone(entry) {
+		return handler.expired(ctx, id, entry)
+	}
+
+	if entry.IsPending() {
+		return handler.notYetActive(ctx, id, entry)
+	}
+
+	if len(entry.Password) != 0 && !handler.isUnlocked(ctx, id, entry) {
+		return renderPage(ctx, http.StatusOK, passwordPage, passwordPageData{})
+	}
+
+	return handler.visit(ctx, id, entry, redirectType(entry))
+}
+
+// preview renders the details of the entry without visiting it, the page continues to its short URL
+func (handler *Handler) preview(ctx echo.Context, id string) error {
+	entry, err := handler.store.GetEntryByID(id)
+	if err != nil {
+		if errors.Cause(err) == shared.ErrNoEntryFound {
+			return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, err)
+		}
+
+		return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+	}
+
+	if isGone(entry) {
+		return handler.expired(ctx, id, entry)
+	}
+
+	if entry.IsPending() {
+		return handler.notYetActive(ctx, id, entry)
+	}
+
+	return renderPage(ctx, http.StatusOK, previewPage, newPreviewPageData(entry, handler.getURL(ctx)+"/"+id))
+}
+
+// isGone reports whether the entry has expired or has no visits left
+func isGone(entry *shared.Entry) bool {
+	return entry.Public.Expired || (entry.Public.RemainingVisits != nil && *entry.Public.RemainingVisits <= 0)
+}
+
+// expired renders the expired page of the entry with 410 Gone
+func (handler *Handler) expired(ctx echo.Context, id string, entry *shared.Entry) error {
+	data := expiredPageData{ID: id}
+	if entry.Public.Expired {
+		data.Expiration = entry.Public.Expiration.Format(g.DefaultTimeFormat)
+	}
+
+	return renderPage(ctx, http.StatusGone, handler.expiredPage, data)
+}
+
+// notYetActive renders the not yet active page of the entry with the configured status
+func (handler *Handler) notYetActive(ctx echo.Context, id string, entry *shared.Entry) error {
+	return renderPage(ctx, g.GetConfig().NotYetActiveStatus, handler.pendingPage, notYetActivePageData{
+		ID:        id,
+		ValidFrom: entry.Public.ValidFrom.Format(g.DefaultTimeFormat),
+	})
+}
+
+// visit registers the visitor and redirects to the URL of the entry with the status. Entries which
+// require the interstitial render the preview page instead, which links to the URL directly.
+// Every visit counts against the visit limit of the entry.
+func (handler *Handler) visit(ctx echo.Context, id string, entry *shared.Entry, status int) error {
+	if err := handler.store.ClaimVisit(id, entry); err != nil {
+		if errors.Cause(err) == stores.ErrVisitLimitReached {
+			return handler.expired(ctx, id, entry)
+		}
+
+		return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+	}
+
+	handler.RegisterVisitor(id, ctx)
+
+	if entry.Public.Interstitial {
+		// the visitor has unlocked a protected entry already
+		data := newPreviewPageData(entry, entry.Public.URL)
+		data.Protected = false
+
+		return renderPage(ctx, http.StatusOK, previewPage, data)
+	}
+
+	return ctx.Redirect(status, entry.Public.URL)
+}
+
+// redirectTypes are the supported status codes of redirects
+var redirectTypes = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// redirectType returns the status code of the redirect to the entry, falling back to the configured default
+func redirectType(entry *shared.Entry) int {
+	if entry.Public.RedirectType != 0 {
+		return entry.Public.RedirectType
+	}
+
+	return g.GetConfig().RedirectType
+}
+
+// unlock verifies the posted password of a protected entry and redirects to its URL. Too many failed
+// attempts lock out the entry and the client, a successful attempt sets the unlock cookie.
+func (handler *Handler) unlock(ctx echo.Context) error {
+	id := ctx.Request().URL.Path[1:]
+	entry, err := handler.store.GetEntryByID(id)
+	if err != nil {
+		if errors.Cause(err) == shared.ErrNoEntryFound {
+			return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, err)
+		}
+
+		return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+	}
+
+	if isGone(entry) {
+		return handler.expired(ctx, id, entry)
+	}
+
+	if entry.IsPending() {
+		return handler.notYetActive(ctx, id, entry)
+	}
+
+	// only the password form is posted, the other entries are visited with GET
+	if len(entry.Password) == 0 {
+		ctx.Response().Header().Set(echo.HeaderAllow, http.MethodGet)
+		return FailureResponse(ctx, http.StatusMethodNotAllowed, ApiErrorHTTPMethod,
+			errors.Errorf("the entry '%s' is not protected by a password", id))
+	}
+
+	// the attempt is counted before the password is compared, so parallel attempts cannot get around the limits
+	subjects := handler.attemptSubjects(ctx, id)
+	for _, subject := range subjects {
+		remaining, err := handler.store.ClaimAttempt(subject.name, subject.max)
+		if err != nil {
+			return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+		}
+
+		if remaining > 0 {
+			ctx.Response().Header().Set("Retry-After", ceilSeconds(remaining))
+			return unlockFailure(ctx, http.StatusTooManyRequests, ApiErrorLockedOut,
+				errors.Errorf("%s is locked out", subject.name), "Too many failed attempts, please try again later.")
+		}
+	}
+
+	payload := new(PasswordPayLoad)
+	if err = ctx.Bind(payload); err == nil {
+		err = bcrypt.CompareHashAndPassword(entry.Password, []byte(payload.Password))
+	}
+
+	if err != nil {
+		logger.Infof("Failed attempt to unlock '%s' from %s", id, handler.clientIP(ctx))
+		return unlockFailure(ctx, http.StatusUnauthorized, ApiErrorPasswordInvalid, err, "Wrong password, please try again.")
+	}
+
+	for _, subject := range subjects {
+		if err := handler.store.ResetFailedAttempts(subject.name); err != nil {
+			logger.Errorf("Could not reset failed attempts of %s: %v", subject.name, err)
+		}
+	}
+
+	handler.setUnlockCookie(ctx, id, entry)
+
+	return handler.visit(ctx, id, entry, http.StatusSeeOther)
+}
+
+// attemptSubject is counted on attempts to unlock an entry, it is locked out after max failures
+type attemptSubject struct {
+	name string
+	max  int
+}
+
+// attemptSubjects returns the entry and the client IP, a client is locked out from all entries
+func (handler *Handler) attemptSubjects(ctx echo.Context, id string) []attemptSubject {
+	conf := g.GetConfig().Password
+	subjects := []attemptSubject{{name: "ip:" + handler.clientIP(ctx), max: conf.MaxAttempts}}
+	if conf.MaxAttemptsPerURL > 0 {
+		subjects = append(subjects, attemptSubject{name: "url:" + id, max: conf.MaxAttemptsPerURL})
+	}
+
+	return subjects
+}
+
+// unlockFailure responds with the error to API clients which posted JSON, and with the password page to browsers
+func unlockFailure(ctx echo.Context, status int, he HandlerError, err error, message string) error {
+	if strings.HasPrefix(ctx.Request().Header.Get(echo.HeaderContentType), echo.MIMEApplicationJSON) {
+		return FailureResponse(ctx, status, he, err)
+	}
+
+	return renderPage(ctx, status, passwordPage, passwordPageData{Error: message})
+}
+
+// isUnlocked reports whether the request carries a valid unlock cookie for the entry
+func (handler *Handler) isUnlocked(ctx echo.Context, id string, entry *shared.Entry) bool {
+	if handler.cookieLifetime <= 0 {
+		return false
+	}
+
+	cookie, err := ctx.Cookie(unlockCookiePrefix + id)
+	if err != nil {
+		return false
+	}
+
+	parts := strings.SplitN(cookie.Value, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(parts[1]), []byte(unlockSignature(id, entry, expires)))
+}
+
+// setUnlockCookie sets the cookie which keeps the entry unlocked for the configured lifetime
+func (handler *Handler) setUnlockCookie(ctx echo.Context, id string, entry *shared.Entry) {
+	if handler.cookieLifetime <= 0 {
+		return
+	}
+
+	expires := time.Now().Add(handler.cookieLifetime)
+	ctx.SetCookie(&http.Cookie{
+		Name:     unlockCookiePrefix + id,
+		Value:    fmt.Sprintf("%d.%s", expires.Unix(), unlockSignature(id, entry, expires.Unix())),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(handler.cookieLifetime / time.Second),
+		Secure:   isTLS(ctx),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// unlockSignature signs the id and the expiry of an unlock cookie with the private key. The password
+// hash is signed as well, so changing the password of the entry invalidates its cookies.
+func unlockSignature(id string, entry *shared.Entry, expires int64) string {
+	mac := hmac.New(sha256.New, util.GetPrivateKey())
+	fmt.Fprintf(mac, "%s|%d|", id, expires)
+	mac.Write(entry.Password)
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -7,15 +7,21 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
-	"strings"
 
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/stores"
 	"github.com/srelab/url-shortener/pkg/stores/shared"
 	"github.com/srelab/url-shortener/pkg/util"
 
 	"github.com/labstack/echo"
+	"github.com/pkg/errors"
 )
 
-const prefix = "/api/v1/urls"
+const (
+	prefix = "/api/v1/urls"
+
+	defaultListLimit = 100
+)
 
 type UrlHandler struct {
 	*Handler
@@ -23,12 +29,20 @@ type UrlHandler struct {
 
 func (handler UrlHandler) Init() {
 	group := handler.engine.Group(prefix)
-	group.GET("", handler.all)
-	group.POST("", handler.create)
+	// every request is rate limited by the client IP, authenticated by an api key or a bearer token, see authorize,
+	// and then rate limited by the caller
+	read := []echo.MiddlewareFunc{
+		handler.limitClient("read", handler.limits.read), handler.authorize(shared.ScopeRead), handler.rateLimit("read", handler.limits.read),
+	}
+	group.GET("", handler.all, read...)
+	group.POST("", handler.create,
+		handler.limitClient("create", handler.limits.create), handler.authorize(shared.ScopeCreate), handler.rateLimit("create", handler.limits.create))
 
-	group.GET("/:id/lookup", handler.lookup)
-	group.GET("/:id/visitors", handler.visitors)
-	group.DELETE("/:id/:hash", handler.delete)
+	group.GET("/:id/lookup", handler.lookup, read...)
+	group.GET("/:id/visitors", handler.visitors, read...)
+	// the deletion URL authorizes the changes of its entry, they are limited like the creations
+	group.PATCH("/:id/:hash", handler.update, handler.rateLimit("create", handler.limits.create))
+	group.DELETE("/:id/:hash", handler.delete, handler.rateLimit("create", handler.limits.create))
 }
 
 func (handler *Handler) create(ctx echo.Context) error {
@@ -37,14 +51,37 @@ func (handler *Handler) create(ctx echo.Context) error {
 		return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
 	}
 
+	owner, team := callerIdentity(ctx)
+
+	dedupe := g.GetConfig().DedupeURLs
+	if payload.Dedupe != nil {
+		dedupe = *payload.Dedupe
+	}
+
 	id, delID, err := handler.store.CreateEntry(shared.Entry{
-		Public:     shared.EntryPublicData{URL: payload.URL, Expiration: payload.Expiration},
-		RemoteAddr: ctx.RealIP(),
-	}, payload.ID, payload.Password)
+		Public: shared.EntryPublicData{
+			URL: payload.URL, Expiration: payload.Expiration, ValidFrom: payload.ValidFrom,
+			RedirectType: payload.RedirectType, Interstitial: payload.Interstitial, MaxVisits: payload.MaxVisits,
+		},
+		RemoteAddr: handler.clientIP(ctx),
+		Owner:      owner,
+		Team:       team,
+	}, payload.ID, payload.Password, dedupe, ctx.Request().Host)
 
 	if err != nil {
-		if strings.Contains(err.Error(), shared.ErrEntryAlreadyExist.Error()) {
+		switch errors.Cause(err) {
+		case shared.ErrEntryAlreadyExist:
 			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorResourceAlreadyExists, err)
+		case stores.ErrReservedID:
+			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorResourceIDReserved, err)
+		case stores.ErrInvalidID, stores.ErrNoValidURL, stores.ErrInvalidValidity, stores.ErrExpirationInPast:
+			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
+		case stores.ErrRedirectLoop, stores.ErrRedirectChainTooLong:
+			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorRedirectChain, err)
+		}
+
+		if policyErr, ok := errors.Cause(err).(*stores.PolicyError); ok {
+			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorURLPolicy, err, policyErr.Rule)
 		}
 
 		return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
@@ -52,16 +89,35 @@ func (handler *Handler) create(ctx echo.Context) error {
 
 	payload.ID = id
 	payload.URL = fmt.Sprintf("%s/%s", handler.getURL(ctx), id)
-	payload.DeletionURL = fmt.Sprintf(
-		"%s/%s/%s", handler.getDeletionURL(ctx, prefix), id, url.QueryEscape(base64.RawURLEncoding.EncodeToString(delID)),
-	)
+	// an existing entry was returned, its deletion URL is only known to its creator
+	if delID != nil {
+		payload.DeletionURL = fmt.Sprintf(
+			"%s/%s/%s", handler.getDeletionURL(ctx, prefix), id, url.QueryEscape(base64.RawURLEncoding.EncodeToString(delID)),
+		)
+	}
 
 	return SuccessResponse(ctx, http.StatusOK, &HandlerResult{Result: payload})
 }
 
 func (handler *Handler) all(ctx echo.Context) error {
-	entries, err := handler.store.GetEntries()
+	payload := new(ListPayLoad)
+	if err := ctx.Bind(payload); err != nil {
+		return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
+	}
+
+	if payload.Limit == 0 {
+		payload.Limit = defaultListLimit
+	}
+
+	query := visibility(ctx)
+	query.Cursor, query.Limit = payload.Cursor, payload.Limit
+
+	entries, nextCursor, err := handler.store.GetEntries(query)
 	if err != nil {
+		if errors.Cause(err) == shared.ErrInvalidCursor {
+			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
+		}
+
 		return FailureResponse(ctx, http.StatusNotFound, ApiErrorSystem, err)
 	}
 
@@ -82,7 +138,8 @@ func (handler *Handler) all(ctx echo.Context) error {
 	}
 
 	return SuccessResponse(ctx, http.StatusOK, &HandlerResult{
-		Result: entries,
+		Result:     entries,
+		Pagination: CursorPagination{Cursor: payload.Cursor, NextCursor: nextCursor, Limit: payload.Limit},
 	})
 }
 
@@ -91,7 +148,16 @@ func (handler *Handler) lookup(ctx echo.Context) error {
 	entry, err := handler.store.GetEntryByID(id)
 
 	if err != nil {
-		return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, err)
+		if errors.Cause(err) == shared.ErrNoEntryFound {
+			return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, err)
+		}
+
+		return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+	}
+
+	// the entries of other owners are not revealed
+	if !canAccess(ctx, entry) {
+		return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, shared.ErrNoEntryFound)
 	}
 
 	return SuccessResponse(ctx, http.StatusOK, &HandlerResult{
@@ -99,6 +165,46 @@ func (handler *Handler) lookup(ctx echo.Context) error {
 	})
 }
 
+func (handler *Handler) update(ctx echo.Context) error {
+	givenHmac, err := base64.RawURLEncoding.DecodeString(ctx.Param("hash"))
+	if err != nil {
+		return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
+	}
+
+	payload := new(UpdatePayLoad)
+	if err := ctx.Bind(payload); err != nil {
+		return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
+	}
+
+	entry, err := handler.store.UpdateEntry(ctx.Param("id"), givenHmac, stores.EntryUpdate{
+		URL: payload.URL, Expiration: payload.Expiration, Password: payload.Password, ValidFrom: payload.ValidFrom,
+		RedirectType: payload.RedirectType, Interstitial: payload.Interstitial, MaxVisits: payload.MaxVisits,
+	}, ctx.Request().Host)
+
+	if err != nil {
+		switch errors.Cause(err) {
+		case stores.ErrHmacVerificationFailed:
+			return FailureResponse(ctx, http.StatusForbidden, ApiErrorHashInvalid, err)
+		case shared.ErrNoEntryFound:
+			return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, err)
+		case stores.ErrNoValidURL, stores.ErrInvalidValidity, stores.ErrExpirationInPast:
+			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
+		case stores.ErrRedirectLoop, stores.ErrRedirectChainTooLong:
+			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorRedirectChain, err)
+		}
+
+		if policyErr, ok := errors.Cause(err).(*stores.PolicyError); ok {
+			return FailureResponse(ctx, http.StatusBadRequest, ApiErrorURLPolicy, err, policyErr.Rule)
+		}
+
+		return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+	}
+
+	return SuccessResponse(ctx, http.StatusOK, &HandlerResult{
+		Result: entry.Public,
+	})
+}
+
 func (handler *Handler) delete(ctx echo.Context) error {
 	givenHmac, err := base64.RawURLEncoding.DecodeString(ctx.Param("hash"))
 	if err != nil {
@@ -113,14 +219,48 @@ func (handler *Handler) delete(ctx echo.Context) error {
 }
 
 func (handler *Handler) visitors(ctx echo.Context) error {
-	id := ctx.Param("id")
-	visitors, err := handler.store.GetVisitors(id)
+	payload := new(VisitorsPayLoad)
+	if err := ctx.Bind(payload); err != nil {
+		return FailureResponse(ctx, http.StatusBadRequest, ApiErrorParameter, err)
+	}
+
+	if payload.Limit == 0 {
+		payload.Limit = defaultListLimit
+	}
+
+	if getPrincipal(ctx) != nil {
+		entry, err := handler.store.GetEntryByID(ctx.Param("id"))
+		if err != nil && errors.Cause(err) != shared.ErrNoEntryFound {
+			return FailureResponse(ctx, http.StatusInternalServerError, ApiErrorSystem, err)
+		}
+
+		if err != nil || !canAccess(ctx, entry) {
+			return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, shared.ErrNoEntryFound)
+		}
+	}
+
+	// one more visitor than requested tells whether there is a following page
+	query := shared.VisitorQuery{Offset: payload.Offset, Limit: payload.Limit + 1}
+	if payload.From != nil {
+		query.From = payload.From.Time
+	}
 
+	if payload.To != nil {
+		query.To = payload.To.Time
+	}
+
+	visitors, err := handler.store.GetVisitors(ctx.Param("id"), query)
 	if err != nil {
 		return FailureResponse(ctx, http.StatusNotFound, ApiErrorResourceNotExists, err)
 	}
 
+	hasMore := len(visitors) > payload.Limit
+	if hasMore {
+		visitors = visitors[:payload.Limit]
+	}
+
 	return SuccessResponse(ctx, http.StatusOK, &HandlerResult{
-		Result: visitors,
+		Result:     visitors,
+		Pagination: OffsetPagination{Offset: payload.Offset, Limit: payload.Limit, HasMore: hasMore},
 	})
 }
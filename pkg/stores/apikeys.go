@@ -0,0 +1,112 @@
+package stores
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// ErrInvalidAPIKey is returned when an api key is malformed, unknown or its secret does not match
+var ErrInvalidAPIKey = errors.New("invalid api key")
+
+// ErrInvalidScope is returned when an api key should be created without an owner or with an unknown scope
+var ErrInvalidScope = errors.New("an api key needs an owner and one of the scopes create, read or admin")
+
+// apiKeySeparator separates the id of an api key from its secret
+const apiKeySeparator = "."
+
+// CreateAPIKey creates an api key of the owner with the scopes. The returned key is the id of the
+// key and its secret, it is only known to the caller.
+func (store *Store) CreateAPIKey(owner string, scopes []string) (string, *shared.APIKey, error) {
+	if strings.TrimSpace(owner) == "" || len(scopes) == 0 {
+		return "", nil, ErrInvalidScope
+	}
+
+	for _, scope := range scopes {
+		if scope != shared.ScopeCreate && scope != shared.ScopeRead && scope != shared.ScopeAdmin {
+			return "", nil, errors.Wrapf(ErrInvalidScope, "unknown scope '%s'", scope)
+		}
+	}
+
+	id, err := randomString(6, hex.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := randomString(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", nil, err
+	}
+
+	apiKey := shared.APIKey{
+		ID:        id,
+		Hash:      hashSecret(secret),
+		Owner:     owner,
+		Scopes:    scopes,
+		CreatedOn: &shared.Datetime{Time: time.Now()},
+	}
+
+	if err := store.storage.CreateAPIKey(apiKey); err != nil {
+		return "", nil, errors.Wrap(err, "could not create api key")
+	}
+
+	return id + apiKeySeparator + secret, &apiKey, nil
+}
+
+// Authenticate returns the api key of the given key, or ErrInvalidAPIKey
+func (store *Store) Authenticate(key string) (*shared.APIKey, error) {
+	parts := strings.SplitN(key, apiKeySeparator, 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, ErrInvalidAPIKey
+	}
+
+	apiKey, err := store.storage.GetAPIKey(parts[0])
+	if err != nil {
+		if errors.Cause(err) == shared.ErrNoEntryFound {
+			return nil, ErrInvalidAPIKey
+		}
+
+		return nil, errors.Wrap(err, "could not get api key")
+	}
+
+	if !hmac.Equal(apiKey.Hash, hashSecret(parts[1])) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	return apiKey, nil
+}
+
+// GetAPIKeys returns every api key
+func (store *Store) GetAPIKeys() ([]shared.APIKey, error) {
+	keys, err := store.storage.GetAPIKeys()
+	return keys, errors.Wrap(err, "could not get api keys")
+}
+
+// DeleteAPIKey revokes the api key with the id
+func (store *Store) DeleteAPIKey(id string) error {
+	return errors.Wrap(store.storage.DeleteAPIKey(id), "could not delete api key")
+}
+
+// hashSecret returns the stored hash of the secret of an api key, the secrets are random
+// so a plain hash is sufficient
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// randomString encodes n random bytes
+func randomString(n int, encode func([]byte) string) (string, error) {
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return "", errors.Wrap(err, "could not read random bytes")
+	}
+
+	return encode(raw), nil
+}
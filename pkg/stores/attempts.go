@@ -0,0 +1,119 @@
+package stores
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/logger"
+)
+
+// attemptPolicy is the brute-force protection of the failed attempts of a subject, e.g. of an
+// entry or of a client. Its counters are kept in the storage, so all instances share them.
+type attemptPolicy struct {
+	window     time.Duration // failed attempts are forgotten after this time without a failure
+	lockout    time.Duration // the first lockout, every further lockout doubles it
+	maxLockout time.Duration
+}
+
+// newAttemptPolicy parses the durations of the policy
+func newAttemptPolicy(window, lockout, maxLockout string) (attemptPolicy, error) {
+	var policy attemptPolicy
+	var err error
+
+	if policy.window, err = time.ParseDuration(window); err != nil {
+		return policy, errors.Wrap(err, "could not parse attempt window")
+	}
+
+	if policy.lockout, err = time.ParseDuration(lockout); err != nil {
+		return policy, errors.Wrap(err, "could not parse lockout")
+	}
+
+	if policy.maxLockout, err = time.ParseDuration(maxLockout); err != nil {
+		return policy, errors.Wrap(err, "could not parse max lockout")
+	}
+
+	return policy, nil
+}
+
+// lockoutFor returns the duration of the lockout with the level, starting at 1
+func (policy attemptPolicy) lockoutFor(level int64) time.Duration {
+	lockout := policy.lockout
+	for i := int64(1); i < level && lockout < policy.maxLockout; i++ {
+		lockout *= 2
+	}
+
+	if lockout > policy.maxLockout {
+		return policy.maxLockout
+	}
+
+	return lockout
+}
+
+// LockedOut returns the remaining lockout of the subject, it is zero if the subject is not locked out
+func (store *Store) LockedOut(subject string) (time.Duration, error) {
+	_, remaining, err := store.storage.GetCounter("lockout:" + subject)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not get lockout")
+	}
+
+	return remaining, nil
+}
+
+// ClaimAttempt counts an attempt of the subject before it is checked, so parallel attempts cannot
+// get more than max guesses. It returns the remaining lockout if the attempt is refused: the subject
+// is locked out, or the attempt is the first one over max and starts a lockout. Every lockout within
+// the max lockout of the previous one lasts twice as long. A successful attempt should reset the
+// attempts with ResetFailedAttempts.
+func (store *Store) ClaimAttempt(subject string, max int) (time.Duration, error) {
+	if remaining, err := store.LockedOut(subject); err != nil || remaining > 0 {
+		return remaining, err
+	}
+
+	attempts, err := store.storage.IncreaseCounter("attempts:"+subject, store.attempts.window)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count attempt")
+	}
+
+	if max > 0 && attempts == int64(max)+1 {
+		return store.lockOut(subject, max)
+	}
+
+	// a parallel attempt may have started a lockout since the first check
+	if remaining, err := store.LockedOut(subject); err != nil || remaining > 0 {
+		return remaining, err
+	}
+
+	if max > 0 && attempts > int64(max) {
+		// the lockout is being started by a parallel attempt
+		return store.attempts.lockout, nil
+	}
+
+	return 0, nil
+}
+
+// lockOut starts the next lockout of the subject and forgets its attempts, they start over once
+// the lockout is over. The lockout is stored before the attempts are deleted, so no parallel
+// attempt gets through in between.
+func (store *Store) lockOut(subject string, failures int) (time.Duration, error) {
+	level, err := store.storage.IncreaseCounter("lockouts:"+subject, store.attempts.maxLockout+store.attempts.window)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count lockout")
+	}
+
+	lockout := store.attempts.lockoutFor(level)
+	if _, err := store.storage.IncreaseCounter("lockout:"+subject, lockout); err != nil {
+		return 0, errors.Wrap(err, "could not lock out")
+	}
+
+	if err := store.storage.DeleteCounter("attempts:" + subject); err != nil {
+		return 0, errors.Wrap(err, "could not reset attempts")
+	}
+
+	logger.Warnf("Locked out %s for %s after %d failed attempts (lockout #%d)", subject, lockout, failures, level)
+	return lockout, nil
+}
+
+// ResetFailedAttempts forgets the failed attempts of the subject, the level of its lockouts is kept
+func (store *Store) ResetFailedAttempts(subject string) error {
+	return errors.Wrap(store.storage.DeleteCounter("attempts:"+subject), "could not reset failed attempts")
+}
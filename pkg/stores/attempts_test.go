@@ -0,0 +1,47 @@
+package stores
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptsLockout(t *testing.T) {
+	store := &Store{storage: newMemoryStorage(t), attempts: attemptPolicy{window: time.Minute, lockout: time.Minute, maxLockout: 3 * time.Minute}}
+
+	for _, lockout := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute} {
+		for i, want := range []time.Duration{0, 0, lockout} {
+			if got, err := store.ClaimAttempt("ip:127.0.0.1", 2); err != nil || got != want {
+				t.Errorf("attempt %d: expected lockout %s, got %s (%v)", i+1, want, got, err)
+			}
+		}
+
+		if remaining, _ := store.LockedOut("ip:127.0.0.1"); remaining <= 0 {
+			t.Error("expected the subject to be locked out")
+		}
+
+		if got, _ := store.ClaimAttempt("ip:127.0.0.1", 2); got <= 0 {
+			t.Error("expected the attempt of a locked out subject to be refused")
+		}
+
+		// the lockout is over
+		store.storage.DeleteCounter("lockout:ip:127.0.0.1")
+	}
+
+	if remaining, _ := store.LockedOut("ip:127.0.0.2"); remaining != 0 {
+		t.Errorf("expected another subject not to be locked out, got %s", remaining)
+	}
+}
+
+func TestResetFailedAttempts(t *testing.T) {
+	store := &Store{storage: newMemoryStorage(t), attempts: attemptPolicy{window: time.Minute, lockout: time.Minute, maxLockout: time.Hour}}
+
+	for i := 0; i < 4; i++ {
+		if got, err := store.ClaimAttempt("url:abc", 2); err != nil || got != 0 {
+			t.Fatalf("attempt %d: expected no lockout, got %s (%v)", i+1, got, err)
+		}
+
+		if i%2 == 1 {
+			store.ResetFailedAttempts("url:abc")
+		}
+	}
+}
@@ -0,0 +1,663 @@
+package bolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	entriesBucket   = []byte("entries")   // bucket for id-to-entry mappings
+	visitorsBucket  = []byte("visitors")  // bucket holding one nested bucket of visits per entry id
+	sequencesBucket = []byte("sequences") // bucket holding one nested bucket per named counter
+	urlsBucket      = []byte("urls")      // bucket for url-hash-to-id mappings of deduplicated entries
+	countersBucket  = []byte("counters")  // bucket for expiring counters, see encodeCounter
+	apiKeysBucket   = []byte("apikeys")   // bucket for id-to-api-key mappings
+)
+
+// Storage implements the shared.Storage interface
+type Storage struct {
+	db   *bolt.DB
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New opens (or creates) the bolt database file and starts the sweeping of expired entries.
+func New(path string, sweepInterval string) (*Storage, error) {
+	interval, err := time.ParseDuration(sweepInterval)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse sweep interval")
+	}
+
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open bolt db '%s'", path)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{entriesBucket, visitorsBucket, sequencesBucket, urlsBucket, countersBucket, apiKeysBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return errors.Wrapf(err, "Could not create bucket '%s'", bucket)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	storage := &Storage{db: db, stop: make(chan struct{}), done: make(chan struct{})}
+	go storage.sweep(interval)
+
+	return storage, nil
+}
+
+// sweep periodically removes the expired entries and their visitors until the storage is closed.
+func (storage *Storage) sweep(interval time.Duration) {
+	defer close(storage.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-storage.stop:
+			return
+		case <-ticker.C:
+			if err := storage.removeExpiredEntries(); err != nil {
+				logger.Errorf("Could not sweep expired entries: %v", err)
+			}
+		}
+	}
+}
+
+// removeExpiredEntries deletes every entry whose expiration time and retention have passed.
+func (storage *Storage) removeExpiredEntries() error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		var expired [][]byte
+
+		err := tx.Bucket(entriesBucket).ForEach(func(key, raw []byte) error {
+			var entry shared.Entry
+			if err := json.Unmarshal(raw, &entry); err != nil {
+				logger.Warnf("Could not unmarshal JSON for entry '%s': %v", key, err)
+				return nil
+			}
+
+			if entry.IsRemoved() {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, key := range expired {
+			logger.Debugf("Sweeping expired entry '%s'", key)
+			if err := deleteEntry(tx, key); err != nil {
+				return err
+			}
+		}
+
+		if err := removeDanglingURLs(tx); err != nil {
+			return err
+		}
+
+		return removeExpiredCounters(tx)
+	})
+}
+
+// removeExpiredCounters deletes the counters whose ttl has passed.
+func removeExpiredCounters(tx *bolt.Tx) error {
+	var expired [][]byte
+
+	now := time.Now()
+	err := tx.Bucket(countersBucket).ForEach(func(name, raw []byte) error {
+		if _, expiresAt := decodeCounter(raw); !expiresAt.IsZero() && !now.Before(expiresAt) {
+			expired = append(expired, append([]byte(nil), name...))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, name := range expired {
+		if err := tx.Bucket(countersBucket).Delete(name); err != nil {
+			return errors.Wrapf(err, "Could not delete counter '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// encodeCounter encodes the value and the expiration of a counter as two big endian int64,
+// the expiration in unix nanoseconds and zero for counters which never expire
+func encodeCounter(value int64, expiresAt time.Time) []byte {
+	raw := make([]byte, 16)
+	binary.BigEndian.PutUint64(raw, uint64(value))
+	if !expiresAt.IsZero() {
+		binary.BigEndian.PutUint64(raw[8:], uint64(expiresAt.UnixNano()))
+	}
+
+	return raw
+}
+
+// decodeCounter decodes a counter encoded by encodeCounter
+func decodeCounter(raw []byte) (int64, time.Time) {
+	if len(raw) != 16 {
+		return 0, time.Time{}
+	}
+
+	value, expiresAt := int64(binary.BigEndian.Uint64(raw)), int64(binary.BigEndian.Uint64(raw[8:]))
+	if expiresAt == 0 {
+		return value, time.Time{}
+	}
+
+	return value, time.Unix(0, expiresAt)
+}
+
+// getCounter returns the value and the expiration of the named counter, expired counters are zero
+func getCounter(tx *bolt.Tx, name string) (int64, time.Time) {
+	raw := tx.Bucket(countersBucket).Get([]byte(name))
+	if raw == nil {
+		return 0, time.Time{}
+	}
+
+	value, expiresAt := decodeCounter(raw)
+	if !expiresAt.IsZero() && !time.Now().Before(expiresAt) {
+		return 0, time.Time{}
+	}
+
+	return value, expiresAt
+}
+
+// removeDanglingURLs deletes the url hashes which are indexed for entries that are gone.
+func removeDanglingURLs(tx *bolt.Tx) error {
+	var dangling [][]byte
+
+	entries := tx.Bucket(entriesBucket)
+	err := tx.Bucket(urlsBucket).ForEach(func(hash, id []byte) error {
+		if entries.Get(id) == nil {
+			dangling = append(dangling, append([]byte(nil), hash...))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range dangling {
+		if err := tx.Bucket(urlsBucket).Delete(hash); err != nil {
+			return errors.Wrapf(err, "Could not delete url hash '%s'", hash)
+		}
+	}
+
+	return nil
+}
+
+// deleteEntry removes the entry and its visitors bucket within the given transaction.
+func deleteEntry(tx *bolt.Tx, key []byte) error {
+	if err := tx.Bucket(entriesBucket).Delete(key); err != nil {
+		return errors.Wrapf(err, "Could not delete entry '%s'", key)
+	}
+
+	err := tx.Bucket(visitorsBucket).DeleteBucket(key)
+	if err != nil && err != bolt.ErrBucketNotFound {
+		return errors.Wrapf(err, "Could not delete visitors of entry '%s'", key)
+	}
+
+	return nil
+}
+
+// getEntry reads and unmarshals an entry within the given transaction, expired entries are treated as missing.
+func getEntry(tx *bolt.Tx, id string) (*shared.Entry, error) {
+	raw := tx.Bucket(entriesBucket).Get([]byte(id))
+	if raw == nil {
+		return nil, shared.ErrNoEntryFound
+	}
+
+	var entry *shared.Entry
+	if err := json.Unmarshal(raw, &entry); err != nil {
+		errmsg := fmt.Sprintf("Error unmarshalling JSON for entry '%s': %v  (json str: '%s')", id, err, raw)
+
+		logger.Error(errmsg)
+		return nil, errors.Wrap(err, errmsg)
+	}
+
+	if entry.IsRemoved() {
+		return nil, shared.ErrNoEntryFound
+	}
+
+	return entry, nil
+}
+
+// setVisitStats derives the visit count and the last visit time from the visitors bucket of the entry.
+func setVisitStats(tx *bolt.Tx, id string, entry *shared.Entry) {
+	// default to start-of-epoch if nobody has visited yet
+	entry.Public.LastVisit = &shared.Datetime{Time: time.Unix(0, 0)}
+	entry.Public.VisitCount = 0
+
+	visits := tx.Bucket(visitorsBucket).Bucket([]byte(id))
+	if visits == nil {
+		return
+	}
+
+	// every visit takes the next sequence of the bucket, so the sequence is the visit count
+	entry.Public.VisitCount = int(visits.Sequence())
+
+	_, raw := visits.Cursor().Last()
+	if raw == nil {
+		return
+	}
+
+	var visitor shared.Visitor
+	if err := json.Unmarshal(raw, &visitor); err != nil {
+		logger.Warnf("Could not unmarshal JSON for last visitor to entry '%s': %v  (got string: '%s')", id, err, raw)
+		return
+	}
+
+	entry.Public.LastVisit = visitor.Timestamp
+}
+
+// CreateEntry creates an entry (path->url mapping), it returns shared.ErrEntryAlreadyExist if the id is taken.
+func (storage *Storage) CreateEntry(entry shared.Entry, id string) error {
+	logger.Debugf("Creating entry '%s'", id)
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not marshal JSON for entry %s: %v", id, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getEntry(tx, id); err == nil {
+			return errors.Wrapf(shared.ErrEntryAlreadyExist, "Could not create entry '%s'", id)
+		}
+
+		// an expired entry which has not been swept yet is replaced together with its visitors
+		if err := deleteEntry(tx, []byte(id)); err != nil {
+			return err
+		}
+
+		return errors.Wrapf(tx.Bucket(entriesBucket).Put([]byte(id), raw), "Could not put entry '%s'", id)
+	})
+}
+
+// UpdateEntry replaces an existing entry, it returns shared.ErrNoEntryFound if the entry is gone.
+// The visitors are kept, they are removed together with the entry.
+func (storage *Storage) UpdateEntry(id string, entry shared.Entry) error {
+	logger.Debugf("Updating entry '%s'", id)
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not marshal JSON for entry %s: %v", id, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		if _, err := getEntry(tx, id); err != nil {
+			return errors.Wrapf(err, "Could not update entry '%s'", id)
+		}
+
+		return errors.Wrapf(tx.Bucket(entriesBucket).Put([]byte(id), raw), "Could not put entry '%s'", id)
+	})
+}
+
+// DeleteEntry deletes an entry and all associated stored data.
+func (storage *Storage) DeleteEntry(id string) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(entriesBucket).Get([]byte(id)) == nil {
+			logger.Warnf("Tried to delete entry '%s' but it's already gone", id)
+			return nil
+		}
+
+		return deleteEntry(tx, []byte(id))
+	})
+}
+
+// GetEntryByID looks up an entry by its path and returns a pointer to a
+// shared.Entry instance, with the visit count and last visit time set
+// properly.
+func (storage *Storage) GetEntryByID(id string) (*shared.Entry, error) {
+	var entry *shared.Entry
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		var err error
+		if entry, err = getEntry(tx, id); err != nil {
+			return err
+		}
+
+		setVisitStats(tx, id, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// GetEntries returns a page of entries, in the form of a map of path->shared.Entry, and the
+// cursor of the following page. The cursor is the last id of the page, entries are ordered by
+// their id and the cursor is empty on the last page.
+func (storage *Storage) GetEntries(query shared.EntryQuery) (map[string]shared.Entry, string, error) {
+	entries := map[string]shared.Entry{}
+	lastID, nextCursor := "", ""
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(entriesBucket).Cursor()
+
+		key, _ := cursor.First()
+		if query.Cursor != "" {
+			if key, _ = cursor.Seek([]byte(query.Cursor)); key != nil && string(key) == query.Cursor {
+				key, _ = cursor.Next()
+			}
+		}
+
+		for ; key != nil; key, _ = cursor.Next() {
+			if query.Full(len(entries)) {
+				// there are more entries, the following page starts after the last one of this page
+				nextCursor = lastID
+				return nil
+			}
+
+			id := string(key)
+			entry, err := getEntry(tx, id)
+			if err != nil {
+				logger.Warnf("Could not get entry '%s': %s", id, err)
+				continue
+			}
+
+			if !query.Matches(entry) {
+				continue
+			}
+
+			setVisitStats(tx, id, entry)
+			entries[id] = *entry
+			lastID = id
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Could not iterate over the entries")
+	}
+
+	return entries, nextCursor, nil
+}
+
+// RegisterVisitors adds the visits to the visitors buckets of their entries, in one transaction.
+func (storage *Storage) RegisterVisitors(visits []shared.Visit) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		for _, visit := range visits {
+			id := visit.EntryID
+
+			// the visitors are removed together with the entry, so there is nothing to expire here
+			if tx.Bucket(entriesBucket).Get([]byte(id)) == nil {
+				logger.Debugf("Skip the visit of the missing entry '%s'", id)
+				continue
+			}
+
+			data, err := json.Marshal(visit.Visitor)
+			if err != nil {
+				errmsg := fmt.Sprintf("Could not marshal JSON for entry %s: %s", id, err)
+
+				logger.Error(errmsg)
+				return errors.Wrap(err, errmsg)
+			}
+
+			visitors, err := tx.Bucket(visitorsBucket).CreateBucketIfNotExists([]byte(id))
+			if err != nil {
+				return errors.Wrapf(err, "Could not create visitors bucket for ID %s", id)
+			}
+
+			seq, err := visitors.NextSequence()
+			if err != nil {
+				return errors.Wrapf(err, "Could not get next visit sequence for ID %s", id)
+			}
+
+			// big endian keys keep the visits ordered by their registration
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+
+			if err := visitors.Put(key, data); err != nil {
+				return errors.Wrapf(err, "Could not register visitor for ID %s", id)
+			}
+		}
+
+		return nil
+	})
+}
+
+// GetVisitors returns the visitors for a path which are selected by the query, the most recent visit first.
+func (storage *Storage) GetVisitors(id string, query shared.VisitorQuery) ([]shared.Visitor, error) {
+	collector := shared.NewVisitorCollector(query)
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		visits := tx.Bucket(visitorsBucket).Bucket([]byte(id))
+		if visits == nil {
+			return nil
+		}
+
+		cursor := visits.Cursor()
+		for key, raw := cursor.Last(); key != nil; key, raw = cursor.Prev() {
+			var value shared.Visitor
+			if err := json.Unmarshal(raw, &value); err != nil {
+				errmsg := fmt.Sprintf("Could not unmarshal json for visit '%s': %v", id, err)
+
+				logger.Error(errmsg)
+				return errors.Wrap(err, errmsg)
+			}
+
+			if collector.Add(value) {
+				return nil
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get visitors")
+	}
+
+	return collector.Visitors, nil
+}
+
+// NextSequence increments the named counter and returns its new value, the first value is 1.
+// The counter is the sequence of a nested bucket, so it is kept in the same way as the visit count.
+func (storage *Storage) NextSequence(name string) (uint64, error) {
+	var value uint64
+
+	err := storage.db.Update(func(tx *bolt.Tx) error {
+		sequence, err := tx.Bucket(sequencesBucket).CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return errors.Wrapf(err, "Could not create sequence bucket '%s'", name)
+		}
+
+		value, err = sequence.NextSequence()
+		return errors.Wrapf(err, "Could not get next value of sequence '%s'", name)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+// GetURLIndex returns the id which is indexed for the url hash, or shared.ErrNoEntryFound.
+func (storage *Storage) GetURLIndex(hash string) (string, error) {
+	var id string
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(urlsBucket).Get([]byte(hash))
+		if raw == nil {
+			return shared.ErrNoEntryFound
+		}
+
+		id = string(raw)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// SetURLIndex indexes the id for the url hash. The expiration is not needed, the
+// index is swept as soon as the indexed entry is gone.
+func (storage *Storage) SetURLIndex(hash, id string, expiration time.Duration) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		return errors.Wrapf(tx.Bucket(urlsBucket).Put([]byte(hash), []byte(id)), "Could not put url hash '%s'", hash)
+	})
+}
+
+// IncreaseCounter increments the named counter and returns its new value, the counter
+// expires after the ttl unless it is increased again.
+func (storage *Storage) IncreaseCounter(name string, ttl time.Duration) (int64, error) {
+	var value int64
+
+	err := storage.db.Update(func(tx *bolt.Tx) error {
+		value, _ = getCounter(tx, name)
+		value++
+
+		var expiresAt time.Time
+		if ttl > 0 {
+			expiresAt = time.Now().Add(ttl)
+		}
+
+		return errors.Wrapf(tx.Bucket(countersBucket).Put([]byte(name), encodeCounter(value, expiresAt)), "Could not put counter '%s'", name)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return value, nil
+}
+
+// GetCounter returns the value of the named counter and the time until it expires, a missing counter is zero.
+func (storage *Storage) GetCounter(name string) (int64, time.Duration, error) {
+	var value int64
+	var expiresAt time.Time
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		value, expiresAt = getCounter(tx, name)
+		return nil
+	})
+	if err != nil || expiresAt.IsZero() {
+		return value, 0, err
+	}
+
+	return value, time.Until(expiresAt), nil
+}
+
+// DeleteCounter deletes the named counter.
+func (storage *Storage) DeleteCounter(name string) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		return errors.Wrapf(tx.Bucket(countersBucket).Delete([]byte(name)), "Could not delete counter '%s'", name)
+	})
+}
+
+// CreateAPIKey stores the api key, it returns shared.ErrEntryAlreadyExist if the id is taken.
+func (storage *Storage) CreateAPIKey(key shared.APIKey) error {
+	raw, err := json.Marshal(key)
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not marshal JSON for api key %s: %v", key.ID, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(apiKeysBucket)
+		if keys.Get([]byte(key.ID)) != nil {
+			return errors.Wrapf(shared.ErrEntryAlreadyExist, "Could not create api key '%s'", key.ID)
+		}
+
+		return errors.Wrapf(keys.Put([]byte(key.ID), raw), "Could not put api key '%s'", key.ID)
+	})
+}
+
+// GetAPIKey returns the api key with the id, or shared.ErrNoEntryFound.
+func (storage *Storage) GetAPIKey(id string) (*shared.APIKey, error) {
+	var key *shared.APIKey
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		raw := tx.Bucket(apiKeysBucket).Get([]byte(id))
+		if raw == nil {
+			return shared.ErrNoEntryFound
+		}
+
+		return errors.Wrapf(json.Unmarshal(raw, &key), "Could not unmarshal api key '%s'", id)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetAPIKeys returns every api key ordered by their id.
+func (storage *Storage) GetAPIKeys() ([]shared.APIKey, error) {
+	var keys []shared.APIKey
+
+	err := storage.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(id, raw []byte) error {
+			var key shared.APIKey
+			if err := json.Unmarshal(raw, &key); err != nil {
+				return errors.Wrapf(err, "Could not unmarshal api key '%s'", id)
+			}
+
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey deletes the api key, it returns shared.ErrNoEntryFound if it does not exist.
+func (storage *Storage) DeleteAPIKey(id string) error {
+	return storage.db.Update(func(tx *bolt.Tx) error {
+		keys := tx.Bucket(apiKeysBucket)
+		if keys.Get([]byte(id)) == nil {
+			return errors.Wrapf(shared.ErrNoEntryFound, "Could not delete api key '%s'", id)
+		}
+
+		return errors.Wrapf(keys.Delete([]byte(id)), "Could not delete api key '%s'", id)
+	})
+}
+
+// Close stops the sweeping and closes the bolt database.
+func (storage *Storage) Close() error {
+	close(storage.stop)
+	<-storage.done
+
+	if err := storage.db.Close(); err != nil {
+		errmsg := fmt.Sprintf("Could not close the bolt database: %s", err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	return nil
+}
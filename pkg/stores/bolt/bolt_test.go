@@ -0,0 +1,36 @@
+package bolt
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+	"github.com/srelab/url-shortener/pkg/stores/storagetest"
+)
+
+func TestMain(m *testing.M) {
+	storagetest.Main(m)
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var databases int
+	storagetest.Run(t, func(t *testing.T) shared.Storage {
+		databases++
+
+		storage, err := New(filepath.Join(dir, fmt.Sprintf("main-%d.db", databases)), "1m")
+		if err != nil {
+			t.Fatalf("could not open storage: %v", err)
+		}
+
+		return storage
+	})
+}
@@ -0,0 +1,117 @@
+package stores
+
+import (
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// ErrRedirectLoop is returned when the URL redirects back to the entry through its own short URLs
+var ErrRedirectLoop = errors.New("the URL leads into a redirect loop")
+
+// ErrRedirectChainTooLong is returned when the URL leads through more short URLs than allowed
+var ErrRedirectChainTooLong = errors.New("the URL leads through too many short URLs")
+
+// chainPolicy recognizes the short URLs of this service as destinations of entries
+type chainPolicy struct {
+	hosts    []string // patterns of path.Match, as the domains of the URL policy; empty for the host of the request
+	location string   // path prefix of the short URLs
+	maxDepth int
+	flatten  bool
+}
+
+// newChainPolicy returns the configured policy
+func newChainPolicy() *chainPolicy {
+	conf := g.GetConfig().Chains
+	return &chainPolicy{
+		hosts:    normalizePatterns(conf.Hosts),
+		location: strings.Trim(g.GetConfig().Location, "/"),
+		maxDepth: conf.MaxDepth,
+		flatten:  conf.Flatten,
+	}
+}
+
+// shortID returns the id of the short URL, if the URL is one of this service. Without configured hosts
+// the short URLs are the ones of the host the request was sent to, as the handlers build them.
+func (chains *chainPolicy) shortID(rawURL string, ids customIDRules, host string) (string, bool) {
+	hosts := chains.hosts
+	if len(hosts) == 0 && host != "" {
+		if name, _, err := net.SplitHostPort(host); err == nil {
+			host = name
+		}
+
+		hosts = normalizePatterns([]string{host})
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || !matchDomain(strings.ToLower(strings.TrimSuffix(u.Hostname(), ".")), hosts) {
+		return "", false
+	}
+
+	// the previews of the short URLs do not redirect
+	if u.Query().Get("preview") == "1" {
+		return "", false
+	}
+
+	// the short URLs are served below the location and, behind a proxy which strips it, at the root
+	id := strings.TrimPrefix(u.Path, "/")
+	if chains.location != "" {
+		id = strings.TrimPrefix(id, chains.location+"/")
+	}
+
+	if id == "" || ids.validate(id) != nil {
+		return "", false
+	}
+
+	return id, true
+}
+
+// restricted reports whether the entry guards its URL, so it must not be skipped by a flattened chain
+func restricted(entry *shared.Entry) bool {
+	return len(entry.Password) > 0 || entry.Public.Interstitial || entry.Public.MaxVisits > 0 ||
+		(entry.Public.Expiration != nil && !entry.Public.Expiration.IsZero()) ||
+		(entry.Public.ValidFrom != nil && !entry.Public.ValidFrom.IsZero())
+}
+
+// resolveChain follows the short URLs of this service, starting with the URL of the entry with the id,
+// which is empty for new entries with a generated id. With flattening the URL is replaced by the final
+// destination, up to the first restricted entry. The id of a missing entry the chain ends with is returned
+// as well, it must not be used for the entry, as the chain would become a loop. The host is the one of the
+// request, see shortID.
+func (store *Store) resolveChain(rawURL, id, host string) (string, string, error) {
+	chains := store.chains
+	target, flatten := rawURL, chains.flatten
+
+	seen := map[string]bool{}
+	for {
+		ref, ok := chains.shortID(rawURL, store.customIDs, host)
+		if !ok {
+			return target, "", nil
+		}
+
+		if ref == id || seen[ref] {
+			return "", "", errors.Wrapf(ErrRedirectLoop, "the short URL '%s' is visited twice", ref)
+		}
+
+		entry, err := store.storage.GetEntryByID(ref)
+		if errors.Cause(err) == shared.ErrNoEntryFound {
+			return target, ref, nil
+		} else if err != nil {
+			return "", "", errors.Wrapf(err, "could not follow the short URL '%s'", ref)
+		}
+
+		if len(seen) >= chains.maxDepth {
+			return "", "", errors.Wrapf(ErrRedirectChainTooLong, "at most %d short URLs are followed", chains.maxDepth)
+		}
+
+		seen[ref] = true
+		rawURL = entry.Public.URL
+		if flatten = flatten && !restricted(entry); flatten {
+			target = rawURL
+		}
+	}
+}
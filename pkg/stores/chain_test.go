@@ -0,0 +1,76 @@
+package stores
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+func TestResolveChain(t *testing.T) {
+	store := &Store{
+		storage:   newMemoryStorage(t),
+		customIDs: customIDRules{maxLength: 16},
+		chains:    &chainPolicy{hosts: []string{"sho.rt", "*.sho.rt"}, location: "s", maxDepth: 4, flatten: true},
+	}
+
+	for id, entry := range map[string]shared.Entry{
+		"final":  {Public: shared.EntryPublicData{URL: "https://example.org/final"}},
+		"hop":    {Public: shared.EntryPublicData{URL: "https://sho.rt/s/final"}},
+		"guard":  {Public: shared.EntryPublicData{URL: "https://sho.rt/hop", Interstitial: true}},
+		"behind": {Public: shared.EntryPublicData{URL: "https://sho.rt/guard"}},
+		"deep":   {Public: shared.EntryPublicData{URL: "https://sho.rt/behind"}},
+		"ping":   {Public: shared.EntryPublicData{URL: "https://www.sho.rt/pong"}},
+		"pong":   {Public: shared.EntryPublicData{URL: "https://sho.rt/ping"}},
+		"zero":   {Public: shared.EntryPublicData{URL: "https://sho.rt/final", Expiration: &shared.Datetime{}, ValidFrom: &shared.Datetime{}}},
+	} {
+		if err := store.storage.CreateEntry(entry, id); err != nil {
+			t.Fatalf("could not create entry %s: %v", id, err)
+		}
+	}
+
+	for _, test := range []struct {
+		url, id  string
+		want     string
+		dangling string
+		err      error
+	}{
+		{url: "https://example.org/", want: "https://example.org/"},
+		{url: "https://sho.rt/s/hop+", want: "https://sho.rt/s/hop+"},
+		{url: "https://sho.rt/hop?preview=1", want: "https://sho.rt/hop?preview=1"},
+		{url: "https://SHO.RT/s/hop", want: "https://example.org/final"},
+		{url: "https://sho.rt/behind", want: "https://sho.rt/guard"},
+		{url: "https://sho.rt/zero", want: "https://example.org/final"},
+		{url: "https://sho.rt/missing", want: "https://sho.rt/missing", dangling: "missing"},
+		{url: "https://sho.rt/missing", id: "missing", err: ErrRedirectLoop},
+		{url: "https://sho.rt/hop", id: "final", err: ErrRedirectLoop},
+		{url: "https://sho.rt/ping", err: ErrRedirectLoop},
+		{url: "https://sho.rt/deep", err: ErrRedirectChainTooLong},
+	} {
+		url, dangling, err := store.resolveChain(test.url, test.id, "")
+		if errors.Cause(err) != test.err || url != test.want || dangling != test.dangling {
+			t.Errorf("expected %s of %q to resolve to %q, %q, %v, got %q, %q, %v",
+				test.url, test.id, test.want, test.dangling, test.err, url, dangling, err)
+		}
+	}
+
+	store.chains.flatten = false
+	if url, _, err := store.resolveChain("https://sho.rt/hop", "", ""); err != nil || url != "https://sho.rt/hop" {
+		t.Errorf("expected the chain to be kept, got %q, %v", url, err)
+	}
+
+	store.chains.maxDepth = 0
+	if _, _, err := store.resolveChain("https://sho.rt/final", "", ""); errors.Cause(err) != ErrRedirectChainTooLong {
+		t.Errorf("expected every short URL to be rejected, got %v", err)
+	}
+
+	// without configured hosts the short URLs are the ones of the request host
+	store.chains.hosts, store.chains.maxDepth = nil, 4
+	if _, _, err := store.resolveChain("https://localhost/s/final", "final", "localhost:8080"); errors.Cause(err) != ErrRedirectLoop {
+		t.Errorf("expected the loop through the request host to be detected, got %v", err)
+	}
+
+	if url, _, err := store.resolveChain("https://sho.rt/final", "final", "localhost:8080"); err != nil || url != "https://sho.rt/final" {
+		t.Errorf("expected the URL of another host to be kept, got %q, %v", url, err)
+	}
+}
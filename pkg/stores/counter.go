@@ -0,0 +1,105 @@
+package stores
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// idSequence is the name of the storage counter the sequential ids are generated from
+const idSequence = "ids"
+
+// feistelRounds is the number of rounds of the permutation of obfuscated ids
+const feistelRounds = 4
+
+// counterIDGenerator generates short and monotonically increasing ids from a counter in the storage
+type counterIDGenerator struct {
+	storage   shared.Storage
+	alphabet  string
+	minLength int
+	feistel   *feistel
+}
+
+// newCounterIDGenerator returns a generator which encodes the counter values with the alphabet, padded to
+// the minimal length. A non-empty obfuscation key permutes the values, so the ids do not reveal their order.
+func newCounterIDGenerator(storage shared.Storage, alphabet string, minLength int, obfuscationKey string) *counterIDGenerator {
+	gen := &counterIDGenerator{storage: storage, alphabet: alphabet, minLength: minLength}
+	if obfuscationKey != "" {
+		gen.feistel = newFeistel(obfuscationKey)
+	}
+
+	return gen
+}
+
+// Generate returns the id of the next counter value
+func (gen *counterIDGenerator) Generate() (string, error) {
+	value, err := gen.storage.NextSequence(idSequence)
+	if err != nil {
+		return "", errors.Wrap(err, "could not get next id sequence")
+	}
+
+	if gen.feistel != nil {
+		value = gen.feistel.permute(value)
+	}
+
+	return gen.encode(value), nil
+}
+
+// Collided is a no-op, the id was taken by a custom id and the next counter value is used instead.
+func (gen *counterIDGenerator) Collided(id string, collisions int) {}
+
+// encode returns the value in the base of the alphabet, left padded with its zero to the minimal length
+func (gen *counterIDGenerator) encode(value uint64) string {
+	base := uint64(len(gen.alphabet))
+
+	var id []byte
+	for ; value > 0 || len(id) < gen.minLength; value /= base {
+		id = append(id, gen.alphabet[value%base])
+	}
+
+	for i, j := 0, len(id)-1; i < j; i, j = i+1, j-1 {
+		id[i], id[j] = id[j], id[i]
+	}
+
+	return string(id)
+}
+
+// feistel is a keyed permutation of the lower 32 bits of a value, the upper bits are kept as they are.
+// Being a permutation distinct values stay distinct, while consecutive values look unrelated.
+type feistel struct {
+	keys [feistelRounds]uint32
+}
+
+// newFeistel derives the round keys from the secret
+func newFeistel(secret string) *feistel {
+	sum := sha256.Sum256([]byte(secret))
+
+	f := &feistel{}
+	for i := range f.keys {
+		f.keys[i] = binary.BigEndian.Uint32(sum[i*4:])
+	}
+
+	return f
+}
+
+// permute runs the rounds of the feistel network over the two 16 bit halves of the lower 32 bits
+func (f *feistel) permute(value uint64) uint64 {
+	left, right := uint16(value>>16), uint16(value)
+	for _, key := range f.keys {
+		left, right = right, left^round(right, key)
+	}
+
+	return value&^0xffffffff | uint64(left)<<16 | uint64(right)
+}
+
+// round is the round function of the feistel network, it does not need to be invertible
+func round(half uint16, key uint32) uint16 {
+	x := uint32(half)*0x9e3779b1 ^ key
+	x ^= x >> 15
+	x *= 0x85ebca6b
+	x ^= x >> 13
+
+	return uint16(x ^ x>>16)
+}
@@ -0,0 +1,88 @@
+package stores
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// urlHash returns the key of the entry in the url index of the storage. It covers the URL together with
+// everything sameOptions compares and whether a password is set, so every variant of a URL has its own
+// index and does not replace the index of another one.
+func urlHash(entry *shared.Entry, protected bool) string {
+	fields := []string{
+		entry.Public.URL, entry.Owner, entry.Team, strconv.Itoa(entry.Public.RedirectType), strconv.FormatBool(entry.Public.Interstitial),
+		unixTime(entry.Public.Expiration), unixTime(entry.Public.ValidFrom), strconv.FormatBool(protected),
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// unixTime formats the time to the second like sameTime compares it, an unset time is empty
+func unixTime(t *shared.Datetime) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+// findDuplicate returns the id of the indexed entry of the URL, if its password and expiration match.
+// Any failure is only logged, a new entry is created then.
+func (store *Store) findDuplicate(entry shared.Entry, password string) (string, bool) {
+	id, err := store.storage.GetURLIndex(urlHash(&entry, password != ""))
+	if err != nil {
+		if errors.Cause(err) != shared.ErrNoEntryFound {
+			logger.Warnf("could not look up the url index: %v", err)
+		}
+
+		return "", false
+	}
+
+	existing, err := store.storage.GetEntryByID(id)
+	if err != nil {
+		// the indexed entry is gone, the index is replaced by the new entry
+		return "", false
+	}
+
+	// the id may have been taken over by another entry after the indexed one expired
+	if existing.IsExpired() || !sameOptions(existing, &entry) {
+		return "", false
+	}
+
+	if len(existing.Password) == 0 || password == "" {
+		return id, len(existing.Password) == 0 && password == ""
+	}
+
+	return id, bcrypt.CompareHashAndPassword(existing.Password, []byte(password)) == nil
+}
+
+// indexURL indexes the id for the URL of the entry, a failure only prevents future deduplication
+func (store *Store) indexURL(entry shared.Entry, id string) {
+	if err := store.storage.SetURLIndex(urlHash(&entry, len(entry.Password) > 0), id, entry.GetRetention()); err != nil {
+		logger.Warnf("could not index the url of entry '%s': %v", id, err)
+	}
+}
+
+// sameOptions reports whether both entries of the same owner redirect to the same URL in the same way and time
+func sameOptions(a, b *shared.Entry) bool {
+	return a.Owner == b.Owner && a.Team == b.Team && a.Public.URL == b.Public.URL && a.Public.RedirectType == b.Public.RedirectType &&
+		a.Public.Interstitial == b.Public.Interstitial && sameTime(a.Public.Expiration, b.Public.Expiration) &&
+		sameTime(a.Public.ValidFrom, b.Public.ValidFrom)
+}
+
+// sameTime reports whether both times are unset or equal to the second
+func sameTime(a, b *shared.Datetime) bool {
+	if a == nil || a.IsZero() || b == nil || b.IsZero() {
+		return (a == nil || a.IsZero()) && (b == nil || b.IsZero())
+	}
+
+	return a.Unix() == b.Unix()
+}
@@ -0,0 +1,132 @@
+package stores
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// IDGenerator generates the ids of new entries
+type IDGenerator interface {
+	// Generate returns a new id, the id may already be taken
+	Generate() (string, error)
+	// Collided is called when the generated id was already taken, with the number of
+	// collisions while creating the current entry
+	Collided(id string, collisions int)
+}
+
+// alphabets are the character sets the ids can be generated from
+var alphabets = map[string]string{
+	"base62": "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
+	// base62 without the look-alikes 0, O, I and l
+	"base58":    "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz",
+	"lowercase": "0123456789abcdefghijklmnopqrstuvwxyz",
+}
+
+// ErrInvalidID is returned when a given custom id is not allowed
+var ErrInvalidID = errors.New("the given ID is not allowed")
+
+// newIDGenerator returns the configured generator, counters are kept in the storage
+func newIDGenerator(storage shared.Storage) (IDGenerator, error) {
+	conf := g.GetConfig()
+
+	alphabet, ok := alphabets[conf.ShortedIDAlphabet]
+	if !ok {
+		return nil, errors.Errorf("%s is not a recognized id alphabet", conf.ShortedIDAlphabet)
+	}
+
+	if conf.ShortedIDLength < 1 {
+		return nil, errors.Errorf("the id length must be positive, got %d", conf.ShortedIDLength)
+	}
+
+	switch conf.ShortedIDGenerator {
+	case "random":
+		// the length only grows if the threshold is reached while creating a single entry
+		if conf.ShortedIDCollisionThreshold > maxIDTries {
+			return nil, errors.Errorf("the id collision threshold must not exceed the %d tries to generate an id, got %d",
+				maxIDTries, conf.ShortedIDCollisionThreshold)
+		}
+
+		return newRandomIDGenerator(alphabet, conf.ShortedIDLength, conf.ShortedIDMaxLength, conf.ShortedIDCollisionThreshold), nil
+	case "counter":
+		return newCounterIDGenerator(storage, alphabet, conf.ShortedIDLength, conf.ShortedIDObfuscationKey), nil
+	default:
+		return nil, errors.Errorf("%s is not a recognized id generator", conf.ShortedIDGenerator)
+	}
+}
+
+// randomIDGenerator generates random ids, their length grows when they collide too often
+type randomIDGenerator struct {
+	alphabet  string
+	length    int32
+	maxLength int
+	threshold int
+}
+
+// newRandomIDGenerator returns a generator for ids of the alphabet which start with the given length
+func newRandomIDGenerator(alphabet string, length, maxLength, threshold int) *randomIDGenerator {
+	if maxLength < length {
+		maxLength = length
+	}
+
+	if threshold < 1 {
+		threshold = 1
+	}
+
+	return &randomIDGenerator{alphabet: alphabet, length: int32(length), maxLength: maxLength, threshold: threshold}
+}
+
+// Generate returns a random id of the current length
+func (gen *randomIDGenerator) Generate() (string, error) {
+	max := big.NewInt(int64(len(gen.alphabet)))
+
+	id := make([]byte, atomic.LoadInt32(&gen.length))
+	for i := range id {
+		num, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+
+		id[i] = gen.alphabet[num.Int64()]
+	}
+
+	return string(id), nil
+}
+
+// Collided grows the length of the ids once the collisions reach the threshold, the keyspace of
+// the current length is considered full then. The length is kept in memory only.
+func (gen *randomIDGenerator) Collided(id string, collisions int) {
+	length := len(id)
+	if collisions%gen.threshold != 0 || length >= gen.maxLength {
+		return
+	}
+
+	if atomic.CompareAndSwapInt32(&gen.length, int32(length), int32(length+1)) {
+		logger.Infof("Too many id collisions, the length of generated ids grows to %d", length+1)
+	}
+}
+
+// customIDRules are the constraints of user supplied ids
+type customIDRules struct {
+	maxLength int
+}
+
+// validate returns ErrInvalidID if the id contains anything but letters, digits, '-' and '_' or is too long
+func (rules customIDRules) validate(id string) error {
+	if len(id) > rules.maxLength {
+		return errors.Wrapf(ErrInvalidID, "the id must not be longer than %d characters", rules.maxLength)
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return errors.Wrapf(ErrInvalidID, "the id must only contain letters, digits, '-' and '_', got %q", c)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,210 @@
+package stores
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/memory"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "url-shortener")
+	if err != nil {
+		panic(err)
+	}
+
+	config := g.GetConfig()
+	config.Log.Dir = dir
+	g.SetConfig(config)
+	logger.InitLogger()
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newMemoryStorage returns an empty storage which does not sweep during the tests
+func newMemoryStorage(t *testing.T) *memory.Storage {
+	storage, err := memory.New("1h")
+	if err != nil {
+		t.Fatalf("could not create storage: %v", err)
+	}
+
+	return storage
+}
+
+func TestRandomIDGenerator(t *testing.T) {
+	for name, chars := range alphabets {
+		id, err := newRandomIDGenerator(chars, 6, 8, 3).Generate()
+		if err != nil {
+			t.Fatalf("could not generate %s id: %v", name, err)
+		}
+
+		if len(id) != 6 {
+			t.Errorf("expected %s id of length 6, got %q", name, id)
+		}
+
+		for _, c := range id {
+			if !strings.ContainsRune(chars, c) {
+				t.Errorf("%s id %q contains %q", name, id, c)
+			}
+		}
+	}
+}
+
+func TestRandomIDGeneratorGrowth(t *testing.T) {
+	gen := newRandomIDGenerator(alphabets["base62"], 4, 5, 3)
+
+	gen.Collided("abcd", 1)
+	gen.Collided("abcd", 2)
+	if id, _ := gen.Generate(); len(id) != 4 {
+		t.Errorf("expected length 4 below the threshold, got %q", id)
+	}
+
+	gen.Collided("abcd", 3)
+	if id, _ := gen.Generate(); len(id) != 5 {
+		t.Errorf("expected length 5 after reaching the threshold, got %q", id)
+	}
+
+	// a concurrent creation which collided with the old length must not grow it again
+	gen.Collided("abcd", 3)
+	gen.Collided("abcde", 3)
+	if id, _ := gen.Generate(); len(id) != 5 {
+		t.Errorf("expected length to stay at the maximum 5, got %q", id)
+	}
+}
+
+func TestCounterIDGenerator(t *testing.T) {
+	gen := newCounterIDGenerator(newMemoryStorage(t), alphabets["base62"], 2, "")
+
+	for _, want := range []string{"01", "02", "03"} {
+		if id, err := gen.Generate(); err != nil || id != want {
+			t.Errorf("expected id %q, got %q (%v)", want, id, err)
+		}
+	}
+
+	for value, want := range map[uint64]string{0: "00", 61: "0z", 62: "10", 62 * 62: "100"} {
+		if id := gen.encode(value); id != want {
+			t.Errorf("expected %d to be encoded as %q, got %q", value, want, id)
+		}
+	}
+}
+
+func TestCounterIDGeneratorObfuscation(t *testing.T) {
+	gen := newCounterIDGenerator(newMemoryStorage(t), alphabets["base62"], 4, "secret")
+
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		id, err := gen.Generate()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seen[id] || len(id) > 6 {
+			t.Fatalf("unexpected obfuscated id %q", id)
+		}
+		seen[id] = true
+	}
+
+	if gen.feistel.permute(1<<32|1) != 1<<32|gen.feistel.permute(1) {
+		t.Error("expected the upper bits to be kept")
+	}
+}
+
+func TestCustomIDRules(t *testing.T) {
+	rules := customIDRules{maxLength: 8}
+
+	for _, id := range []string{"a", "my-link", "Under_s1"} {
+		if err := rules.validate(id); err != nil {
+			t.Errorf("expected %q to be valid: %v", id, err)
+		}
+	}
+
+	for _, id := range []string{"toolong12", "a.b", "a/b", "ümlaut"} {
+		if err := rules.validate(id); errors.Cause(err) != ErrInvalidID {
+			t.Errorf("expected %q to be invalid, got %v", id, err)
+		}
+	}
+}
+
+func TestReservedIDs(t *testing.T) {
+	reserved := newReservedIDs("favicon.ico")
+	reserved.add("/api/")
+
+	for _, id := range []string{"api", "API", "api/v1/urls", "/api", "favicon.ico"} {
+		if !reserved.contains(id) {
+			t.Errorf("expected %q to be reserved", id)
+		}
+	}
+
+	for _, id := range []string{"apis", "v1", "favicon"} {
+		if reserved.contains(id) {
+			t.Errorf("expected %q not to be reserved", id)
+		}
+	}
+}
+
+func TestCollisionThresholdValidation(t *testing.T) {
+	config := g.GetConfig()
+	defer g.SetConfig(config)
+
+	for threshold, valid := range map[int]bool{1: true, maxIDTries: true, maxIDTries + 1: false} {
+		conf := config
+		conf.ShortedIDGenerator = "random"
+		conf.ShortedIDCollisionThreshold = threshold
+		g.SetConfig(conf)
+
+		if _, err := newIDGenerator(nil); (err == nil) != valid {
+			t.Errorf("expected the threshold %d to be valid: %v, got %v", threshold, valid, err)
+		}
+	}
+}
+
+// fixedIDGenerator hands out the ids in order and records the collisions
+type fixedIDGenerator struct {
+	ids      []string
+	collided []string
+}
+
+func (gen *fixedIDGenerator) Generate() (string, error) {
+	id := gen.ids[0]
+	gen.ids = gen.ids[1:]
+
+	return id, nil
+}
+
+func (gen *fixedIDGenerator) Collided(id string, collisions int) {
+	gen.collided = append(gen.collided, id)
+}
+
+func TestGeneratedIDsSkipReserved(t *testing.T) {
+	gen := &fixedIDGenerator{ids: []string{"API", "taken", "free"}}
+	store := &Store{
+		storage:  newMemoryStorage(t),
+		ids:      gen,
+		reserved: newReservedIDs("api"),
+		policy:   &urlPolicy{schemes: map[string]bool{"https": true}},
+		chains:   &chainPolicy{},
+	}
+
+	if err := store.storage.CreateEntry(shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org"}}, "taken"); err != nil {
+		t.Fatalf("could not create entry: %v", err)
+	}
+
+	id, _, err := store.CreateEntry(shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org/new"}}, "", "", false, "sho.rt")
+	if err != nil || id != "free" {
+		t.Errorf("expected the entry to be created as %q, got %q, %v", "free", id, err)
+	}
+
+	if fmt.Sprint(gen.collided) != "[API taken]" {
+		t.Errorf("expected the reserved and the taken id to collide, got %v", gen.collided)
+	}
+}
@@ -0,0 +1,444 @@
+package memory
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// item is an entry with the point in time it expires, the zero time never expires
+type item struct {
+	entry     shared.Entry
+	expiresAt time.Time
+}
+
+// visits is the list of visitors of an entry, the most recent visit last
+type visits struct {
+	visitors  []shared.Visitor
+	expiresAt time.Time
+}
+
+// counter is an expiring counter
+type counter struct {
+	value     int64
+	expiresAt time.Time
+}
+
+// Storage implements the shared.Storage interface, everything is lost when the process exits
+type Storage struct {
+	mu        sync.RWMutex
+	entries   map[string]item
+	visits    map[string]visits
+	sequences map[string]uint64
+	urls      map[string]string
+	counters  map[string]counter
+	apiKeys   map[string]shared.APIKey
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// New initializes an empty in-memory storage and starts the sweeping of expired entries.
+func New(sweepInterval string) (*Storage, error) {
+	interval, err := time.ParseDuration(sweepInterval)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse sweep interval")
+	}
+
+	storage := &Storage{
+		entries:   map[string]item{},
+		visits:    map[string]visits{},
+		sequences: map[string]uint64{},
+		urls:      map[string]string{},
+		counters:  map[string]counter{},
+		apiKeys:   map[string]shared.APIKey{},
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go storage.sweep(interval)
+
+	return storage, nil
+}
+
+// sweep periodically removes the expired entries, visitors and counters until the storage is closed.
+func (storage *Storage) sweep(interval time.Duration) {
+	defer close(storage.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-storage.stop:
+			return
+		case <-ticker.C:
+			storage.removeExpired(time.Now())
+		}
+	}
+}
+
+// removeExpired deletes the expired entries with their visitors, the url hashes of missing entries and the expired counters.
+func (storage *Storage) removeExpired(now time.Time) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	for id, it := range storage.entries {
+		if expired(it.expiresAt, now) {
+			logger.Debugf("Sweeping expired entry '%s'", id)
+			delete(storage.entries, id)
+		}
+	}
+
+	for id, v := range storage.visits {
+		if _, ok := storage.entries[id]; !ok || expired(v.expiresAt, now) {
+			delete(storage.visits, id)
+		}
+	}
+
+	for hash, id := range storage.urls {
+		if _, ok := storage.entries[id]; !ok {
+			delete(storage.urls, hash)
+		}
+	}
+
+	for name, c := range storage.counters {
+		if expired(c.expiresAt, now) {
+			delete(storage.counters, name)
+		}
+	}
+}
+
+// expired reports whether the point in time has passed, the zero time never expires
+func expired(expiresAt time.Time, now time.Time) bool {
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// expiresAt returns the point in time a duration from now, zero durations never expire
+func expiresAt(expiration time.Duration) time.Time {
+	if expiration <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().Add(expiration)
+}
+
+// getEntry returns the entry if it exists and is not expired, the caller must hold the lock.
+func (storage *Storage) getEntry(id string, now time.Time) (*shared.Entry, bool) {
+	it, ok := storage.entries[id]
+	if !ok || expired(it.expiresAt, now) {
+		return nil, false
+	}
+
+	entry := it.entry
+
+	// default to start-of-epoch if nobody has visited yet
+	entry.Public.LastVisit = &shared.Datetime{Time: time.Unix(0, 0)}
+	entry.Public.VisitCount = 0
+
+	if v, ok := storage.visits[id]; ok && !expired(v.expiresAt, now) && len(v.visitors) > 0 {
+		entry.Public.VisitCount = len(v.visitors)
+		entry.Public.LastVisit = v.visitors[len(v.visitors)-1].Timestamp
+	}
+
+	return &entry, true
+}
+
+// CreateEntry creates an entry (path->url mapping), it returns shared.ErrEntryAlreadyExist if the id is taken.
+func (storage *Storage) CreateEntry(entry shared.Entry, id string) error {
+	logger.Debugf("Creating entry '%s'", id)
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := storage.getEntry(id, now); ok {
+		return errors.Wrapf(shared.ErrEntryAlreadyExist, "Could not create entry '%s'", id)
+	}
+
+	// an expired entry is replaced together with its visitors
+	delete(storage.visits, id)
+	storage.entries[id] = item{entry: entry, expiresAt: expiresAt(entry.GetRetention())}
+
+	return nil
+}
+
+// UpdateEntry replaces an existing entry, it returns shared.ErrNoEntryFound if the entry is gone.
+// The visitors are kept and expire together with the entry.
+func (storage *Storage) UpdateEntry(id string, entry shared.Entry) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.getEntry(id, time.Now()); !ok {
+		return errors.Wrapf(shared.ErrNoEntryFound, "Could not update entry '%s'", id)
+	}
+
+	it := item{entry: entry, expiresAt: expiresAt(entry.GetRetention())}
+	storage.entries[id] = it
+
+	if v, ok := storage.visits[id]; ok {
+		v.expiresAt = it.expiresAt
+		storage.visits[id] = v
+	}
+
+	return nil
+}
+
+// DeleteEntry deletes an entry and all associated stored data.
+func (storage *Storage) DeleteEntry(id string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.entries[id]; !ok {
+		logger.Warnf("Tried to delete entry '%s' but it's already gone", id)
+	}
+
+	delete(storage.entries, id)
+	delete(storage.visits, id)
+
+	return nil
+}
+
+// GetEntryByID looks up an entry by its path and returns a pointer to a
+// shared.Entry instance, with the visit count and last visit time set
+// properly.
+func (storage *Storage) GetEntryByID(id string) (*shared.Entry, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	entry, ok := storage.getEntry(id, time.Now())
+	if !ok {
+		return nil, shared.ErrNoEntryFound
+	}
+
+	return entry, nil
+}
+
+// GetEntries returns a page of entries, in the form of a map of path->shared.Entry, and the
+// cursor of the following page. The cursor is the last id of the page, entries are ordered by
+// their id and the cursor is empty on the last page.
+func (storage *Storage) GetEntries(query shared.EntryQuery) (map[string]shared.Entry, string, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	ids := make([]string, 0, len(storage.entries))
+	for id := range storage.entries {
+		if id > query.Cursor {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	now := time.Now()
+	entries := map[string]shared.Entry{}
+	lastID := ""
+
+	for _, id := range ids {
+		if query.Full(len(entries)) {
+			return entries, lastID, nil
+		}
+
+		if entry, ok := storage.getEntry(id, now); ok && query.Matches(entry) {
+			entries[id] = *entry
+			lastID = id
+		}
+	}
+
+	return entries, "", nil
+}
+
+// RegisterVisitors adds the visits to the lists of visits of their entries, the visitors expire together with the entry.
+func (storage *Storage) RegisterVisitors(visits []shared.Visit) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	now := time.Now()
+	for _, visit := range visits {
+		id := visit.EntryID
+		if _, ok := storage.getEntry(id, now); !ok {
+			logger.Debugf("Skip the visit of the missing entry '%s'", id)
+			continue
+		}
+
+		v := storage.visits[id]
+		if expired(v.expiresAt, now) {
+			v.visitors = nil
+		}
+
+		v.visitors = append(v.visitors, visit.Visitor)
+		v.expiresAt = storage.entries[id].expiresAt
+		storage.visits[id] = v
+	}
+
+	return nil
+}
+
+// GetVisitors returns the visitors for a path which are selected by the query, the most recent visit first.
+func (storage *Storage) GetVisitors(id string, query shared.VisitorQuery) ([]shared.Visitor, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	v, ok := storage.visits[id]
+	if !ok || expired(v.expiresAt, time.Now()) {
+		return nil, nil
+	}
+
+	collector := shared.NewVisitorCollector(query)
+	for i := len(v.visitors) - 1; i >= 0; i-- {
+		if collector.Add(v.visitors[i]) {
+			break
+		}
+	}
+
+	return collector.Visitors, nil
+}
+
+// NextSequence increments the named counter and returns its new value, the first value is 1.
+func (storage *Storage) NextSequence(name string) (uint64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.sequences[name]++
+	return storage.sequences[name], nil
+}
+
+// GetURLIndex returns the id which is indexed for the url hash, or shared.ErrNoEntryFound.
+func (storage *Storage) GetURLIndex(hash string) (string, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	id, ok := storage.urls[hash]
+	if !ok {
+		return "", shared.ErrNoEntryFound
+	}
+
+	return id, nil
+}
+
+// SetURLIndex indexes the id for the url hash. The expiration is not needed, the
+// index is replaced as soon as the indexed entry is gone.
+func (storage *Storage) SetURLIndex(hash, id string, expiration time.Duration) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.urls[hash] = id
+	return nil
+}
+
+// IncreaseCounter increments the named counter and returns its new value, the counter
+// expires after the ttl unless it is increased again.
+func (storage *Storage) IncreaseCounter(name string, ttl time.Duration) (int64, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	c := storage.counters[name]
+	if expired(c.expiresAt, time.Now()) {
+		c = counter{}
+	}
+
+	c.value++
+	c.expiresAt = expiresAt(ttl)
+	storage.counters[name] = c
+
+	return c.value, nil
+}
+
+// GetCounter returns the value of the named counter and the time until it expires, a missing counter is zero.
+func (storage *Storage) GetCounter(name string) (int64, time.Duration, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	now := time.Now()
+	c, ok := storage.counters[name]
+	if !ok || expired(c.expiresAt, now) {
+		return 0, 0, nil
+	}
+
+	if c.expiresAt.IsZero() {
+		return c.value, 0, nil
+	}
+
+	return c.value, c.expiresAt.Sub(now), nil
+}
+
+// DeleteCounter deletes the named counter.
+func (storage *Storage) DeleteCounter(name string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	delete(storage.counters, name)
+	return nil
+}
+
+// CreateAPIKey stores the api key, it returns shared.ErrEntryAlreadyExist if the id is taken.
+func (storage *Storage) CreateAPIKey(key shared.APIKey) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.apiKeys[key.ID]; ok {
+		return errors.Wrapf(shared.ErrEntryAlreadyExist, "Could not create api key '%s'", key.ID)
+	}
+
+	storage.apiKeys[key.ID] = key
+	return nil
+}
+
+// GetAPIKey returns the api key with the id, or shared.ErrNoEntryFound.
+func (storage *Storage) GetAPIKey(id string) (*shared.APIKey, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	key, ok := storage.apiKeys[id]
+	if !ok {
+		return nil, shared.ErrNoEntryFound
+	}
+
+	return &key, nil
+}
+
+// GetAPIKeys returns every api key ordered by their id.
+func (storage *Storage) GetAPIKeys() ([]shared.APIKey, error) {
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+
+	keys := make([]shared.APIKey, 0, len(storage.apiKeys))
+	for _, key := range storage.apiKeys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].ID < keys[j].ID })
+
+	return keys, nil
+}
+
+// DeleteAPIKey deletes the api key, it returns shared.ErrNoEntryFound if it does not exist.
+func (storage *Storage) DeleteAPIKey(id string) error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if _, ok := storage.apiKeys[id]; !ok {
+		return errors.Wrapf(shared.ErrNoEntryFound, "Could not delete api key '%s'", id)
+	}
+
+	delete(storage.apiKeys, id)
+	return nil
+}
+
+// Close stops the sweeping and drops all the stored data.
+func (storage *Storage) Close() error {
+	close(storage.stop)
+	<-storage.done
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	storage.entries = map[string]item{}
+	storage.visits = map[string]visits{}
+	storage.sequences = map[string]uint64{}
+	storage.urls = map[string]string{}
+	storage.counters = map[string]counter{}
+	storage.apiKeys = map[string]shared.APIKey{}
+
+	return nil
+}
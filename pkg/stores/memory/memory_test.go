@@ -0,0 +1,63 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+	"github.com/srelab/url-shortener/pkg/stores/storagetest"
+)
+
+func TestMain(m *testing.M) {
+	storagetest.Main(m)
+}
+
+func TestStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) shared.Storage {
+		storage, err := New("1m")
+		if err != nil {
+			t.Fatalf("could not create storage: %v", err)
+		}
+
+		return storage
+	})
+}
+
+func TestRemoveExpired(t *testing.T) {
+	storage, err := New("1h")
+	if err != nil {
+		t.Fatalf("could not create storage: %v", err)
+	}
+	defer storage.Close()
+
+	now := time.Now()
+	for id, expiration := range map[string]*shared.Datetime{"expiring": {Time: now.Add(time.Minute)}, "kept": nil} {
+		entry := shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org/" + id, CreatedOn: &shared.Datetime{Time: now}, Expiration: expiration}}
+		if err := storage.CreateEntry(entry, id); err != nil {
+			t.Fatalf("could not create entry %s: %v", id, err)
+		}
+
+		storage.SetURLIndex("hash-"+id, id, 0)
+	}
+
+	storage.RegisterVisitors([]shared.Visit{{EntryID: "expiring"}, {EntryID: "kept"}})
+	storage.IncreaseCounter("expiring", time.Minute)
+	storage.IncreaseCounter("kept", time.Hour)
+
+	storage.removeExpired(now.Add(10 * time.Minute))
+
+	for name, n := range map[string]int{
+		"entries":  len(storage.entries),
+		"visits":   len(storage.visits),
+		"urls":     len(storage.urls),
+		"counters": len(storage.counters),
+	} {
+		if n != 1 {
+			t.Errorf("expected only the unexpired %s to be kept, got %d", name, n)
+		}
+	}
+
+	if _, err := storage.GetEntryByID("kept"); err != nil {
+		t.Errorf("expected the entry without expiration to be kept, got %v", err)
+	}
+}
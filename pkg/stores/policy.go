@@ -0,0 +1,192 @@
+package stores
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/g"
+)
+
+// The rules of the URL policy, see PolicyError
+const (
+	RuleScheme         = "scheme"
+	RuleDeniedDomain   = "denied_domain"
+	RuleAllowedDomain  = "allowed_domain"
+	RulePrivateAddress = "private_address"
+	RuleResolution     = "resolution"
+)
+
+// PolicyError is returned when a URL violates a rule of the URL policy
+type PolicyError struct {
+	Rule   string
+	Reason string
+}
+
+func (err *PolicyError) Error() string {
+	return fmt.Sprintf("the URL violates the %s rule: %s", err.Rule, err.Reason)
+}
+
+// Resolver looks up the IP addresses of a host, it is implemented by net.Resolver
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// privateNetworks are the networks which are not reachable from the internet, or only from the host itself
+var privateNetworks = parseNetworks(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.168.0.0/16", "198.18.0.0/15", "224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+// parseNetworks parses the CIDR notations of networks
+func parseNetworks(cidrs ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+// urlPolicy decides which URLs may be shortened
+type urlPolicy struct {
+	schemes        map[string]bool
+	allowedDomains []string // patterns of path.Match, empty allows every domain
+	deniedDomains  []string
+	rejectPrivate  bool
+	resolver       Resolver
+	timeout        time.Duration
+}
+
+// newURLPolicy returns the configured policy
+func newURLPolicy() (*urlPolicy, error) {
+	conf := g.GetConfig().URLPolicy
+
+	timeout, err := time.ParseDuration(conf.ResolveTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse the resolve timeout")
+	}
+
+	policy := &urlPolicy{
+		schemes:        map[string]bool{},
+		allowedDomains: normalizePatterns(conf.AllowedDomains),
+		deniedDomains:  normalizePatterns(conf.DeniedDomains),
+		rejectPrivate:  conf.RejectPrivateAddresses,
+		resolver:       net.DefaultResolver,
+		timeout:        timeout,
+	}
+
+	for _, scheme := range conf.AllowedSchemes {
+		policy.schemes[strings.ToLower(scheme)] = true
+	}
+
+	for _, pattern := range append(policy.allowedDomains, policy.deniedDomains...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid domain pattern '%s'", pattern)
+		}
+	}
+
+	return policy, nil
+}
+
+// normalizePatterns lower cases the domain patterns
+func normalizePatterns(patterns []string) []string {
+	normalized := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), ".")); pattern != "" {
+			normalized = append(normalized, pattern)
+		}
+	}
+
+	return normalized
+}
+
+// matchDomain reports whether the host matches one of the patterns, '*' matches any part of a host
+// name, e.g. '*.example.org' matches every subdomain of example.org but not example.org itself
+func matchDomain(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// check returns a PolicyError if the URL violates a rule of the policy
+func (policy *urlPolicy) check(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ErrNoValidURL
+	}
+
+	if scheme := strings.ToLower(u.Scheme); !policy.schemes[scheme] {
+		return &PolicyError{Rule: RuleScheme, Reason: fmt.Sprintf("the scheme '%s' is not allowed", scheme)}
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if matchDomain(host, policy.deniedDomains) {
+		return &PolicyError{Rule: RuleDeniedDomain, Reason: fmt.Sprintf("the domain '%s' is denied", host)}
+	}
+
+	if len(policy.allowedDomains) > 0 && !matchDomain(host, policy.allowedDomains) {
+		return &PolicyError{Rule: RuleAllowedDomain, Reason: fmt.Sprintf("the domain '%s' is not allowed", host)}
+	}
+
+	if !policy.rejectPrivate || host == "" {
+		return nil
+	}
+
+	return policy.checkAddresses(host)
+}
+
+// checkAddresses returns a PolicyError if the host is or resolves to a private address
+func (policy *urlPolicy) checkAddresses(host string) error {
+	// the loopback names are never sent to the resolver, see RFC 6761
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return &PolicyError{Rule: RulePrivateAddress, Reason: fmt.Sprintf("the host '%s' is a loopback name", host)}
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = append(ips, ip)
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), policy.timeout)
+		defer cancel()
+
+		addrs, err := policy.resolver.LookupIPAddr(ctx, host)
+		if err != nil || len(addrs) == 0 {
+			return &PolicyError{Rule: RuleResolution, Reason: fmt.Sprintf("the host '%s' could not be resolved", host)}
+		}
+
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		for _, network := range privateNetworks {
+			if network.Contains(ip) {
+				return &PolicyError{Rule: RulePrivateAddress, Reason: fmt.Sprintf("the host '%s' has the private address %s", host, ip)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// UseResolver replaces the resolver of the host names of the URLs, e.g. in tests
+func (store *Store) UseResolver(resolver Resolver) {
+	store.policy.resolver = resolver
+}
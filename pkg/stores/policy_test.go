@@ -0,0 +1,108 @@
+package stores
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/g"
+)
+
+// fakeResolver resolves the hosts of the map, every other host is unknown
+type fakeResolver map[string][]string
+
+func (resolver fakeResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := resolver[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	addrs := make([]net.IPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+
+	return addrs, nil
+}
+
+func TestURLPolicy(t *testing.T) {
+	config := g.GetConfig()
+	defer g.SetConfig(config)
+
+	conf := config
+	conf.URLPolicy.AllowedSchemes = []string{"HTTPS", "ftp"}
+	conf.URLPolicy.AllowedDomains = []string{"example.org", "*.example.org", "*.example.net."}
+	conf.URLPolicy.DeniedDomains = []string{"admin.*.example.org"}
+	g.SetConfig(conf)
+
+	policy, err := newURLPolicy()
+	if err != nil {
+		t.Fatalf("could not create the policy: %v", err)
+	}
+
+	policy.resolver = fakeResolver{
+		"example.org":          {"93.184.216.34"},
+		"www.example.org":      {"93.184.216.34", "2606:2800:220:1::1"},
+		"metadata.example.org": {"169.254.169.254"},
+		"rebind.example.net":   {"93.184.216.34", "127.0.0.1"},
+		"v6.example.org":       {"fd00::1"},
+	}
+
+	for _, test := range []struct {
+		url  string
+		rule string
+	}{
+		{"https://example.org/", ""},
+		{"https://WWW.Example.org./path", ""},
+		{"ftp://www.example.org/file", ""},
+		{"http://example.org/", RuleScheme},
+		{"javascript:alert(1)", RuleScheme},
+		{"data:text/html,hello", RuleScheme},
+		{"https://admin.eu.example.org/", RuleDeniedDomain},
+		{"https://example.net/", RuleAllowedDomain},
+		{"https://example.org.evil.com/", RuleAllowedDomain},
+		{"https://metadata.example.org/", RulePrivateAddress},
+		{"https://rebind.example.net/", RulePrivateAddress},
+		{"https://v6.example.org/", RulePrivateAddress},
+		{"https://missing.example.org/", RuleResolution},
+	} {
+		err := policy.check(test.url)
+		if test.rule == "" {
+			if err != nil {
+				t.Errorf("expected %s to be allowed, got %v", test.url, err)
+			}
+
+			continue
+		}
+
+		if policyErr, ok := errors.Cause(err).(*PolicyError); !ok || policyErr.Rule != test.rule {
+			t.Errorf("expected %s to violate the %s rule, got %v", test.url, test.rule, err)
+		}
+	}
+}
+
+func TestURLPolicyAddresses(t *testing.T) {
+	policy := &urlPolicy{schemes: map[string]bool{"http": true}, rejectPrivate: true, resolver: fakeResolver{}}
+	for ip, private := range map[string]bool{
+		"127.0.0.1": true, "10.0.0.1": true, "172.31.255.255": true, "192.168.1.1": true, "169.254.169.254": true,
+		"100.64.0.1": true, "0.0.0.0": true, "[::1]": true, "[::]": true, "[fe80::1]": true, "[::ffff:127.0.0.1]": true,
+		"8.8.8.8": false, "172.32.0.1": false, "[2001:4860:4860::8888]": false,
+	} {
+		err := policy.check("http://" + ip + "/")
+		if policyErr, ok := err.(*PolicyError); private && (!ok || policyErr.Rule != RulePrivateAddress) {
+			t.Errorf("expected %s to be rejected as private address, got %v", ip, err)
+		} else if !private && err != nil {
+			t.Errorf("expected %s to be allowed, got %v", ip, err)
+		}
+	}
+
+	if err, ok := policy.check("http://app.localhost/").(*PolicyError); !ok || err.Rule != RulePrivateAddress {
+		t.Errorf("expected the loopback name to be rejected, got %v", err)
+	}
+
+	policy.rejectPrivate = false
+	if err := policy.check("http://localhost/"); err != nil {
+		t.Errorf("expected private addresses to be allowed, got %v", err)
+	}
+}
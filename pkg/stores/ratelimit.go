@@ -0,0 +1,83 @@
+package stores
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// sweepEvery is the number of taken tokens after which the full buckets are dropped
+const sweepEvery = 1000
+
+// bucket is the state of a token bucket, the tokens at the time of the last update
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill returns the tokens of the bucket at the point in time
+func (b bucket) refill(limit shared.RateLimit, now time.Time) float64 {
+	return math.Min(float64(limit.Burst), b.tokens+now.Sub(b.updated).Seconds()*limit.Rate)
+}
+
+// bucketLimiter keeps the token buckets of the rate limits in memory, so they are not shared between
+// multiple instances. A bucket which is full is the same as a missing one, those are dropped regularly.
+type bucketLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]bucket
+	limits  map[string]shared.RateLimit // the rate limit of every bucket, needed for the sweep
+	taken   int
+	now     func() time.Time
+}
+
+// newBucketLimiter returns a limiter without buckets
+func newBucketLimiter() *bucketLimiter {
+	return &bucketLimiter{buckets: map[string]bucket{}, limits: map[string]shared.RateLimit{}, now: time.Now}
+}
+
+// TakeToken takes a token from the bucket of the key, if there is one left
+func (limiter *bucketLimiter) TakeToken(key string, limit shared.RateLimit) (shared.RateLimitResult, error) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.now()
+	if limiter.taken++; limiter.taken%sweepEvery == 0 {
+		limiter.sweep(now)
+	}
+
+	b, ok := limiter.buckets[key]
+	if !ok {
+		b = bucket{tokens: float64(limit.Burst), updated: now}
+	}
+
+	tokens := b.refill(limit, now)
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+
+	limiter.buckets[key] = bucket{tokens: tokens, updated: now}
+	limiter.limits[key] = limit
+
+	return limit.Result(tokens, allowed), nil
+}
+
+// sweep drops the buckets which are full, the caller must hold the lock
+func (limiter *bucketLimiter) sweep(now time.Time) {
+	for key, b := range limiter.buckets {
+		if limit := limiter.limits[key]; b.refill(limit, now) >= float64(limit.Burst) {
+			delete(limiter.buckets, key)
+			delete(limiter.limits, key)
+		}
+	}
+}
+
+// TakeToken takes a token from the bucket of the key. The buckets are shared by the storage if it
+// supports it, e.g. redis, otherwise they are kept by this instance.
+func (store *Store) TakeToken(key string, limit shared.RateLimit) (shared.RateLimitResult, error) {
+	result, err := store.limiter.TakeToken(key, limit)
+	return result, errors.Wrap(err, "could not take a token")
+}
@@ -0,0 +1,44 @@
+package stores
+
+import (
+	"testing"
+	"time"
+
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+func TestBucketLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newBucketLimiter()
+	limiter.now = func() time.Time { return now }
+
+	limit := shared.RateLimit{Rate: 0.5, Burst: 2}
+	for i, want := range []bool{true, true, false} {
+		result, _ := limiter.TakeToken("ip:a", limit)
+		if result.Allowed != want {
+			t.Fatalf("expected request %d allowed=%t, got %+v", i, want, result)
+		}
+	}
+
+	result, _ := limiter.TakeToken("ip:b", limit)
+	if !result.Allowed || result.Remaining != 1 {
+		t.Errorf("expected the bucket of another key to be full, got %+v", result)
+	}
+
+	result, _ = limiter.TakeToken("ip:a", limit)
+	if result.RetryAfter != 2*time.Second || result.Reset != 4*time.Second {
+		t.Errorf("expected the next token in 2s and a full bucket in 4s, got %+v", result)
+	}
+
+	// a token is added every two seconds
+	now = now.Add(2 * time.Second)
+	if result, _ = limiter.TakeToken("ip:a", limit); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("expected the refilled token to be taken, got %+v", result)
+	}
+
+	now = now.Add(time.Hour)
+	limiter.sweep(now)
+	if len(limiter.buckets) != 0 {
+		t.Errorf("expected the full buckets to be swept, got %v", limiter.buckets)
+	}
+}
@@ -0,0 +1,102 @@
+package redis
+
+import (
+	"strings"
+)
+
+const (
+	entryKeyPrefix        = "entry:"        // prefix for path-to-url mappings
+	visitsKeyPrefix       = "visits:"       // prefix for entry-to-[]visit mappings (redis LIST)
+	legacyVisitsKeyPrefix = "entry:visits:" // prefix for the visits without a namespace, kept for existing databases
+	sequenceKeyPrefix     = "sequence:"     // prefix for named counters (redis INCR)
+	urlKeyPrefix          = "url:"          // prefix for url-hash-to-id mappings of deduplicated entries
+	counterKeyPrefix      = "counter:"      // prefix for expiring counters (redis INCR with PEXPIRE)
+	apiKeyKeyPrefix       = "apikey:"       // prefix for id-to-api-key mappings
+	rateKeyPrefix         = "ratelimit:"    // prefix for token buckets (redis HASH)
+)
+
+// keyspace builds the redis keys of a deployment. Every key starts with the namespace of the
+// deployment, so multiple instances (or tenants) can share one redis database, and the entries
+// and the visits live in separate keyspaces so a pattern for one never matches the other.
+// Without a namespace the visits keep their original keys below the entries, which are skipped
+// when the entries are listed.
+type keyspace struct {
+	namespace    string
+	visitsPrefix string
+}
+
+// newKeyspace returns the keyspace for the namespace, a non-empty namespace is separated by a colon
+func newKeyspace(namespace string) keyspace {
+	if namespace == "" {
+		return keyspace{visitsPrefix: legacyVisitsKeyPrefix}
+	}
+
+	if !strings.HasSuffix(namespace, ":") {
+		namespace += ":"
+	}
+
+	return keyspace{namespace: namespace, visitsPrefix: namespace + visitsKeyPrefix}
+}
+
+// entry returns the key of the entry with the id
+func (ks keyspace) entry(id string) string {
+	return ks.namespace + entryKeyPrefix + id
+}
+
+// visits returns the key of the visitors list of the entry with the id
+func (ks keyspace) visits(id string) string {
+	return ks.visitsPrefix + id
+}
+
+// sequence returns the key of the named counter
+func (ks keyspace) sequence(name string) string {
+	return ks.namespace + sequenceKeyPrefix + name
+}
+
+// url returns the key of the id which is indexed for the url hash
+func (ks keyspace) url(hash string) string {
+	return ks.namespace + urlKeyPrefix + hash
+}
+
+// counter returns the key of the named expiring counter
+func (ks keyspace) counter(name string) string {
+	return ks.namespace + counterKeyPrefix + name
+}
+
+// apiKey returns the key of the api key with the id
+func (ks keyspace) apiKey(id string) string {
+	return ks.namespace + apiKeyKeyPrefix + id
+}
+
+// rateLimit returns the key of the token bucket of the rate limit key
+func (ks keyspace) rateLimit(key string) string {
+	return ks.namespace + rateKeyPrefix + key
+}
+
+// apiKeyPattern returns the SCAN pattern matching the keys of all api keys
+func (ks keyspace) apiKeyPattern() string {
+	return escapePattern(ks.namespace+apiKeyKeyPrefix) + "*"
+}
+
+// entryPattern returns the SCAN pattern matching the keys of all entries
+func (ks keyspace) entryPattern() string {
+	return escapePattern(ks.namespace+entryKeyPrefix) + "*"
+}
+
+// entryID extracts the id from the key of an entry, it reports false for keys of other keyspaces
+func (ks keyspace) entryID(key string) (string, bool) {
+	prefix := ks.namespace + entryKeyPrefix
+	if !strings.HasPrefix(key, prefix) || strings.HasPrefix(key, ks.visitsPrefix) {
+		return "", false
+	}
+
+	return strings.TrimPrefix(key, prefix), true
+}
+
+// patternReplacer escapes the special characters of redis glob-style patterns
+var patternReplacer = strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`)
+
+// escapePattern escapes a literal for the use in a redis glob-style pattern
+func escapePattern(literal string) string {
+	return patternReplacer.Replace(literal)
+}
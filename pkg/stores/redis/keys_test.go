@@ -0,0 +1,47 @@
+package redis
+
+import (
+	"testing"
+)
+
+func TestKeyspace(t *testing.T) {
+	tests := []struct {
+		namespace string
+		entry     string
+		visits    string
+		pattern   string
+	}{
+		{"", "entry:tyre", "entry:visits:tyre", "entry:*"},
+		{"tenant", "tenant:entry:tyre", "tenant:visits:tyre", "tenant:entry:*"},
+		{"tenant:", "tenant:entry:tyre", "tenant:visits:tyre", "tenant:entry:*"},
+		{"a*b", "a*b:entry:tyre", "a*b:visits:tyre", `a\*b:entry:*`},
+	}
+
+	for _, test := range tests {
+		keys := newKeyspace(test.namespace)
+
+		if key := keys.entry("tyre"); key != test.entry {
+			t.Errorf("%q: expected entry key %q, got %q", test.namespace, test.entry, key)
+		}
+
+		if key := keys.visits("tyre"); key != test.visits {
+			t.Errorf("%q: expected visits key %q, got %q", test.namespace, test.visits, key)
+		}
+
+		if pattern := keys.entryPattern(); pattern != test.pattern {
+			t.Errorf("%q: expected pattern %q, got %q", test.namespace, test.pattern, pattern)
+		}
+
+		if id, ok := keys.entryID(test.entry); !ok || id != "tyre" {
+			t.Errorf("%q: expected id %q from %q, got %q (%v)", test.namespace, "tyre", test.entry, id, ok)
+		}
+
+		if id, ok := keys.entryID(test.visits); ok {
+			t.Errorf("%q: expected no id from visits key %q, got %q", test.namespace, test.visits, id)
+		}
+	}
+
+	if id, ok := newKeyspace("").entryID("other:entry:abc"); ok {
+		t.Errorf("expected no id from the key of another namespace, got %q", id)
+	}
+}
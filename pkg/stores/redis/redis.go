@@ -3,7 +3,7 @@ package redis
 import (
 	"encoding/json"
 	"fmt"
-	"strings"
+	"strconv"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -12,18 +12,53 @@ import (
 	"github.com/srelab/url-shortener/pkg/stores/shared"
 )
 
-const (
-	entryKeyPrefix       = "entry:"        // prefix for path-to-url mappings
-	entryVisitsKeyPrefix = "entry:visits:" // prefix for entry-to-[]visit mappings (redis LIST)
-)
+const visitorsChunkSize = 100 // number of visits which are read at once while filtering them by time
+
+// registerVisitScript pushes the visit (ARGV[1]) onto the visits list (KEYS[2]) of the entry (KEYS[1]), if
+// the entry exists. The list expires together with the entry, so it never outlives it.
+var registerVisitScript = redis.NewScript(`
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl == -2 then
+	return 0
+end
+
+redis.call('LPUSH', KEYS[2], ARGV[1])
+if ttl > 0 then
+	redis.call('PEXPIRE', KEYS[2], ttl)
+end
+
+return 1
+`)
+
+// takeTokenScript takes a token from the token bucket (KEYS[1]) with the burst (ARGV[1]) and the rate in tokens
+// per millisecond (ARGV[2]) at the time in milliseconds (ARGV[3]). It returns whether a token was taken and the
+// tokens left, the bucket expires once it is full again.
+var takeTokenScript = redis.NewScript(`
+local burst, rate, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens, updated = tonumber(state[1]) or burst, tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'updated', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1)
+
+return {allowed, tostring(tokens)}
+`)
 
 // Store implements the stores.Storage interface
 type Storage struct {
 	client *redis.Client
+	keys   keyspace
 }
 
 // New initializes connection to the redis instance.
-func New(hostaddr, password string, db int, maxRetries int, readTimeout string, writeTimeout string) (*Storage, error) {
+func New(hostaddr, password string, db int, maxRetries int, readTimeout string, writeTimeout string, keyPrefix string) (*Storage, error) {
 	var rt, wt time.Duration
 	var err error
 
@@ -49,7 +84,7 @@ func New(hostaddr, password string, db int, maxRetries int, readTimeout string,
 		return nil, errors.Wrap(err, "Could not connect to redis db0")
 	}
 
-	result := &Storage{client: client}
+	result := &Storage{client: client, keys: newKeyspace(keyPrefix)}
 	return result, nil
 }
 
@@ -74,38 +109,24 @@ func (storage *Storage) keyExists(key string) (exists bool, err error) {
 	return false, nil
 }
 
-// createValue create value in redis via key, that returns an error if the key already exists.
+// createValue atomically creates the value of the key with SET NX, it returns
+// shared.ErrEntryAlreadyExist if the key already exists.
 func (storage *Storage) createValue(key string, raw []byte, expiration time.Duration) error {
 	logger.Debugf("Creating key '%s', expiration %ds", key, expiration/time.Second)
 
-	if expiration < 0 {
-		logger.Infof("Skip the creation of the key '%s', it has expired", key)
-		return nil
-	}
+	logger.Debugf("Setting value for key '%s: '%s''", key, raw)
 
-	exists, err := storage.keyExists(key)
+	created, err := storage.client.SetNX(key, raw, expiration).Result()
 	if err != nil {
-		errmsg := fmt.Sprintf("Could not check existence of key '%s': %s", key, err)
+		errmsg := fmt.Sprintf("Got an unexpected error adding key '%s': %s", key, err)
 
 		logger.Error(errmsg)
 		return errors.Wrap(err, errmsg)
 	}
 
-	if exists == true {
-		errmsg := fmt.Sprintf("Could not create key '%s': already exists", key)
-
-		logger.Error(errmsg)
-		return errors.New(errmsg)
-	}
-
-	logger.Debugf("Setting value for key '%s: '%s''", key, raw)
-
-	status := storage.client.Set(key, raw, expiration)
-	if status.Err() != nil {
-		errmsg := fmt.Sprintf("Got an unexpected error adding key '%s': %s", key, status.Err())
-
-		logger.Error(errmsg)
-		return errors.Wrap(status.Err(), errmsg)
+	if !created {
+		logger.Debugf("Could not create key '%s': already exists", key)
+		return errors.Wrapf(shared.ErrEntryAlreadyExist, "Could not create key '%s'", key)
 	}
 
 	return nil
@@ -126,7 +147,7 @@ func (storage *Storage) delValue(key string) error {
 	if exists == false {
 		errmsg := fmt.Sprintf("Tried to delete key '%s' but it's already gone", key)
 
-		logger.Warnf(errmsg)
+		logger.Warn(errmsg)
 		return err
 	}
 
@@ -144,7 +165,7 @@ func (storage *Storage) delValue(key string) error {
 // CreateEntry creates an entry (path->url mapping) and all associated stored data.
 func (storage *Storage) CreateEntry(entry shared.Entry, id string) error {
 	// add the entry (path->url mapping)
-	logger.Debugf("Creating entry '%s' for user '%s'", id)
+	logger.Debugf("Creating entry '%s'", id)
 
 	raw, err := json.Marshal(entry)
 	if err != nil {
@@ -154,24 +175,62 @@ func (storage *Storage) CreateEntry(entry shared.Entry, id string) error {
 		return errors.Wrap(err, errmsg)
 	}
 
-	entryKey := entryKeyPrefix + id
+	entryKey := storage.keys.entry(id)
 	logger.Debugf("Adding key '%s': %s", entryKey, raw)
 
-	err = storage.createValue(entryKey, raw, entry.GetExpiration())
+	err = storage.createValue(entryKey, raw, entry.GetRetention())
+	if err != nil {
+		return errors.Wrapf(err, "Failed to set key '%s'", entryKey)
+	}
+
+	return nil
+}
+
+// UpdateEntry replaces an existing entry, it returns shared.ErrNoEntryFound if the entry is gone.
+// The TTLs of the entry and of its visitors list follow the new retention.
+func (storage *Storage) UpdateEntry(id string, entry shared.Entry) error {
+	logger.Debugf("Updating entry '%s'", id)
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not marshal JSON for entry %s: %v", id, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	entryKey, entryVisitsKey := storage.keys.entry(id), storage.keys.visits(id)
+	expiration := entry.GetRetention()
+
+	var updated *redis.BoolCmd
+	_, err = storage.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		updated = pipe.SetXX(entryKey, raw, expiration)
+		if expiration > 0 {
+			pipe.Expire(entryVisitsKey, expiration)
+		} else {
+			pipe.Persist(entryVisitsKey)
+		}
+
+		return nil
+	})
 	if err != nil {
-		errmsg := fmt.Sprintf("Failed to set key '%s': %v", entryKey, err)
+		errmsg := fmt.Sprintf("Got an unexpected error updating key '%s': %s", entryKey, err)
 
 		logger.Error(errmsg)
 		return errors.Wrap(err, errmsg)
 	}
 
+	if !updated.Val() {
+		return errors.Wrapf(shared.ErrNoEntryFound, "Could not update key '%s'", entryKey)
+	}
+
 	return nil
 }
 
 // DeleteEntry deletes an entry and all associated stored data.
 func (storage *Storage) DeleteEntry(id string) error {
 	// delete the id-to-url mapping
-	entryKey := entryKeyPrefix + id
+	entryKey := storage.keys.entry(id)
 	err := storage.delValue(entryKey)
 	if err != nil {
 		errmsg := fmt.Sprintf("Could not delete entry id %s: %v", id, err)
@@ -181,7 +240,7 @@ func (storage *Storage) DeleteEntry(id string) error {
 	}
 
 	// delete the visitors list for the id
-	entryVisitsKey := entryVisitsKeyPrefix + id
+	entryVisitsKey := storage.keys.visits(id)
 	err = storage.delValue(entryVisitsKey)
 	if err != nil {
 		errmsg := fmt.Sprintf("Could not delete visitors list for id %s: %v", id, err)
@@ -206,166 +265,528 @@ func (storage *Storage) DeleteEntry(id string) error {
 // shared.Entry instance, with the visit count and last visit time set
 // properly.
 func (storage *Storage) GetEntryByID(id string) (*shared.Entry, error) {
-	entryKey := entryKeyPrefix + id
+	entryKey := storage.keys.entry(id)
 	logger.Debugf("Fetching key: '%s'", entryKey)
 
-	result := storage.client.Get(entryKey)
-	raw, err := result.Bytes()
+	raw, err := storage.client.Get(entryKey).Bytes()
+	if err == redis.Nil {
+		logger.Debugf("Key '%s' does not exist!", entryKey)
+		return nil, shared.ErrNoEntryFound
+	}
+
 	if err != nil {
-		msg := fmt.Sprintf("Error looking up key '%s': %s'", entryKey, err)
-		logger.Warn(msg)
+		errmsg := fmt.Sprintf("Error looking up key '%s': %s'", entryKey, err)
 
-		err = shared.ErrNoEntryFound
-		return nil, err
+		logger.Error(errmsg)
+		return nil, errors.Wrap(err, errmsg)
 	}
 
 	logger.Debugf("Got entry for key '%s': '%s'", entryKey, raw)
 
-	var entry *shared.Entry
-	err = json.Unmarshal(raw, &entry)
+	entry, err := unmarshalEntry(id, raw)
 	if err != nil {
+		return nil, err
+	}
+
+	storage.setVisitStats(map[string]*shared.Entry{id: entry})
+	return entry, nil
+}
+
+// unmarshalEntry decodes the JSON of an entry stored in redis.
+func unmarshalEntry(id string, raw []byte) (*shared.Entry, error) {
+	var entry *shared.Entry
+	if err := json.Unmarshal(raw, &entry); err != nil {
 		errmsg := fmt.Sprintf("Error unmarshalling JSON for entry '%s': %v  (json str: '%s')", id, err, raw)
 
 		logger.Error(errmsg)
 		return nil, errors.Wrap(err, errmsg)
 	}
 
-	// now we interleave the visit count and the last visit time
-	// from the redis sources (we do this so we don't have to rewrite
-	// the entry every time someone visits which is madness)
-	//
-	// first, the visit count is just the length of the visitors list
-	entryVisitsKey := entryVisitsKeyPrefix + id
-	visitCount, err := storage.client.LLen(entryVisitsKey).Result()
-	if err != nil {
-		logger.Warnf("Could not get length of visitor list for id '%s': '%v'", id, err)
-		entry.Public.VisitCount = int(0) // or zero if nobody's visited, that's fine.
-	} else {
-		entry.Public.VisitCount = int(visitCount)
+	return entry, nil
+}
+
+// setVisitStats interleaves the visit count and the last visit time of the entries
+// from the redis sources (we do this so we don't have to rewrite the entry every time
+// someone visits which is madness), all lookups are sent in a single pipeline.
+func (storage *Storage) setVisitStats(entries map[string]*shared.Entry) {
+	type visitStats struct {
+		count *redis.IntCmd
+		last  *redis.StringCmd
 	}
 
-	// grab the timestamp out of the last visitor on the list
-	var visitor *shared.Visitor
+	stats := make(map[string]visitStats, len(entries))
+	pipe := storage.client.Pipeline()
+	for id := range entries {
+		entryVisitsKey := storage.keys.visits(id)
 
-	// default to start-of-epoch if we can't figure it out
-	lastVisit := &shared.Datetime{Time: time.Time(time.Unix(0, 0))}
-	raw, err = storage.client.LIndex(entryVisitsKey, 0).Bytes()
-	if err != nil {
-		logger.Warnf("Could not fetch visitor list for entry '%s': %v", id, err)
-	} else {
-		err = json.Unmarshal(raw, &visitor)
+		// the visit count is just the length of the visitors list and the
+		// timestamp comes out of the last visitor on the list
+		stats[id] = visitStats{count: pipe.LLen(entryVisitsKey), last: pipe.LIndex(entryVisitsKey, 0)}
+	}
+
+	// the errors are checked per command below, a missing list is no failure
+	_, _ = pipe.Exec()
+
+	for id, entry := range entries {
+		visitCount, err := stats[id].count.Result()
+		if err != nil {
+			logger.Warnf("Could not get length of visitor list for id '%s': '%v'", id, err)
+			entry.Public.VisitCount = int(0) // or zero if nobody's visited, that's fine.
+		} else {
+			entry.Public.VisitCount = int(visitCount)
+		}
+
+		// default to start-of-epoch if we can't figure it out
+		lastVisit := &shared.Datetime{Time: time.Time(time.Unix(0, 0))}
+
+		var visitor *shared.Visitor
+		raw, err := stats[id].last.Bytes()
 		if err != nil {
+			logger.Warnf("Could not fetch visitor list for entry '%s': %v", id, err)
+		} else if err = json.Unmarshal(raw, &visitor); err != nil {
 			logger.Warnf("Could not unmarshal JSON for last visitor to entry '%s': %v  (got string: '%s')", id, err, raw)
 		} else {
 			lastVisit = visitor.Timestamp
 		}
+
+		logger.Debugf("Setting last visit time for entry '%s' to '%v'", id, lastVisit)
+		entry.Public.LastVisit = lastVisit
+	}
+}
+
+const (
+	// maxScanRounds bounds the SCAN calls of a page, the entries of other owners may fill the keyspace
+	maxScanRounds = 10
+	// scanCount is asked for by every SCAN of a listing without a limit
+	scanCount = 100
+)
+
+// GetEntries returns a page of entries, in the form of a map of path->shared.Entry, and the
+// cursor of the following page. The keys are iterated with SCAN, so a page may hold a few
+// more entries than the limit if SCAN returns more keys than asked for, and the cursor is empty
+// once the iteration is complete. The entries which are not selected by the query are skipped,
+// every SCAN asks for the missing entries of the page until it is filled or maxScanRounds is
+// reached, so a page may be short although more entries follow. This holds for a listing without
+// a limit as well.
+func (storage *Storage) GetEntries(query shared.EntryQuery) (map[string]shared.Entry, string, error) {
+	var cursor uint64
+	if query.Cursor != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(query.Cursor, 10, 64); err != nil {
+			return nil, "", errors.Wrapf(shared.ErrInvalidCursor, "Could not parse cursor '%s'", query.Cursor)
+		}
 	}
 
-	logger.Debugf("Setting last visit time for entry '%s' to '%v'", id, lastVisit)
-	entry.Public.LastVisit = lastVisit
+	entriesKey := storage.keys.entryPattern()
 
-	return entry, nil
+	found := map[string]*shared.Entry{}
+	for round := 1; ; round++ {
+		var keys []string
+		var err error
+
+		count := query.Limit - len(found)
+		if query.Limit <= 0 {
+			count = scanCount
+		}
+
+		keys, cursor, err = storage.client.Scan(cursor, entriesKey, int64(count)).Result()
+		if err != nil {
+			errmsg := fmt.Sprintf("Could not scan entries for entries prefix '%s': %v", entriesKey, err)
+
+			logger.Error(errmsg)
+			return nil, "", errors.Wrap(err, errmsg)
+		}
+
+		if err := storage.collectEntries(keys, query, found); err != nil {
+			return nil, "", err
+		}
+
+		if cursor == 0 || query.Full(len(found)) || round >= maxScanRounds {
+			break
+		}
+	}
+
+	nextCursor := ""
+	if cursor != 0 {
+		nextCursor = strconv.FormatUint(cursor, 10)
+	}
+
+	storage.setVisitStats(found)
+
+	entries := make(map[string]shared.Entry, len(found))
+	for id, entry := range found {
+		entries[id] = *entry
+	}
+
+	return entries, nextCursor, nil
 }
 
-// GetEntries returns all entries, in the form of a map of path->shared.Entry
-func (storage *Storage) GetEntries() (map[string]shared.Entry, error) {
-	entries := map[string]shared.Entry{}
+// collectEntries fetches the entries of the keys and adds the ones selected by the query to found
+func (storage *Storage) collectEntries(keys []string, query shared.EntryQuery, found map[string]*shared.Entry) error {
+	if len(keys) == 0 {
+		return nil
+	}
 
-	entriesKey := entryKeyPrefix + "*"
-	result := storage.client.Keys(entriesKey)
-	if result.Err() != nil {
-		errmsg := fmt.Sprintf("Could not fetch set of entries for entries prefix '%s': %v", entriesKey, result.Err())
+	values, err := storage.client.MGet(keys...).Result()
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not fetch entries for entries prefix '%s': %v", storage.keys.entryPattern(), err)
 
-		logger.Errorf(errmsg)
-		return nil, errors.Wrap(result.Err(), errmsg)
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
 	}
 
-	for _, key := range result.Val() {
+	for i, key := range keys {
 		logger.Debugf("got key: %s", key)
-		if !strings.HasPrefix(key, entryKeyPrefix) {
+		id, ok := storage.keys.entryID(key)
+		if !ok {
+			continue
+		}
+
+		// the value is nil for keys which expired in the meantime
+		raw, ok := values[i].(string)
+		if !ok {
 			continue
 		}
 
-		id := strings.TrimLeft(key, entryKeyPrefix)
-		entry, err := storage.GetEntryByID(id)
+		entry, err := unmarshalEntry(id, []byte(raw))
 		if err != nil {
 			msg := fmt.Sprintf("Could not get key '%s': %s", key, err)
 			logger.Warn(msg)
-		} else {
-			entries[id] = *entry
+		} else if query.Matches(entry) {
+			found[id] = entry
 		}
 	}
 
-	logger.Debugf("all out of entries")
-	return entries, nil
+	return nil
 }
 
-// RegisterVisitor adds a shared.Visitor to the list of visits for a path.
-func (storage *Storage) RegisterVisitor(id, visitID string, visitor shared.Visitor) error {
-	data, err := json.Marshal(visitor)
+// RegisterVisitors adds the visits to the lists of visits of their entries, in one pipeline.
+func (storage *Storage) RegisterVisitors(visits []shared.Visit) error {
+	_, err := storage.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, visit := range visits {
+			data, err := json.Marshal(visit.Visitor)
+			if err != nil {
+				errmsg := fmt.Sprintf("Could not marshal JSON for entry %s: %s", visit.EntryID, err)
+
+				logger.Error(errmsg)
+				return errors.Wrap(err, errmsg)
+			}
+
+			keys := []string{storage.keys.entry(visit.EntryID), storage.keys.visits(visit.EntryID)}
+			registerVisitScript.Eval(pipe, keys, data)
+		}
+
+		return nil
+	})
+
 	if err != nil {
-		errmsg := fmt.Sprintf("Could not marshal JSON for entry %s, visitID %s: %s", id, visitID, err)
+		errmsg := fmt.Sprintf("Could not register %d visitors: %s", len(visits), err)
 
 		logger.Error(errmsg)
 		return errors.Wrap(err, errmsg)
 	}
 
-	// push the visit data onto a redis list who's key is the url id
-	entryVisitsKey := entryVisitsKeyPrefix + id
-	result := storage.client.LPush(entryVisitsKey, data)
-	if result.Err() != nil {
-		errmsg := fmt.Sprintf("Could not register visitor for ID %s: %s", id, result.Err())
+	return nil
+}
+
+// GetVisitors returns the visitors for a path which are selected by the query, the most recent visit first.
+//
+// Without a time range the page is read directly with LRANGE, otherwise the list is
+// read in chunks until the visits are older than the beginning of the time range.
+func (storage *Storage) GetVisitors(id string, query shared.VisitorQuery) ([]shared.Visitor, error) {
+	entryVisitsKey := storage.keys.visits(id)
+
+	start, chunk := int64(0), int64(visitorsChunkSize)
+	if query.From.IsZero() && query.To.IsZero() {
+		start, chunk = int64(query.Offset), int64(query.Limit)
+		query.Offset = 0
+	}
+
+	collector := shared.NewVisitorCollector(query)
+	for {
+		stop := start + chunk - 1
+		if chunk <= 0 {
+			stop = -1
+		}
+
+		values, err := storage.client.LRange(entryVisitsKey, start, stop).Result()
+		if err != nil {
+			errmsg := fmt.Sprintf("Could not get visitors for id '%s': %s", id, err)
+
+			logger.Error(errmsg)
+			return nil, errors.Wrap(err, errmsg)
+		}
+
+		for _, v := range values {
+			var value shared.Visitor
+			if err := json.Unmarshal([]byte(v), &value); err != nil {
+				errmsg := fmt.Sprintf("Could not unmarshal json for visit '%s': %v", id, err)
+
+				logger.Error(errmsg)
+				return nil, errors.Wrap(err, errmsg)
+			}
+
+			if collector.Add(value) {
+				return collector.Visitors, nil
+			}
+		}
+
+		if stop == -1 || int64(len(values)) < chunk {
+			return collector.Visitors, nil
+		}
+
+		start += chunk
+	}
+}
+
+// NextSequence atomically increments the named counter with INCR and returns its new value, the first value is 1.
+func (storage *Storage) NextSequence(name string) (uint64, error) {
+	key := storage.keys.sequence(name)
+
+	value, err := storage.client.Incr(key).Result()
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not increment key '%s': %s", key, err)
+
+		logger.Error(errmsg)
+		return 0, errors.Wrap(err, errmsg)
+	}
+
+	return uint64(value), nil
+}
+
+// GetURLIndex returns the id which is indexed for the url hash, or shared.ErrNoEntryFound.
+func (storage *Storage) GetURLIndex(hash string) (string, error) {
+	key := storage.keys.url(hash)
+
+	id, err := storage.client.Get(key).Result()
+	if err == redis.Nil {
+		return "", shared.ErrNoEntryFound
+	}
+
+	if err != nil {
+		errmsg := fmt.Sprintf("Error looking up key '%s': %s'", key, err)
+
+		logger.Error(errmsg)
+		return "", errors.Wrap(err, errmsg)
+	}
+
+	return id, nil
+}
+
+// SetURLIndex indexes the id for the url hash, the index expires together with the entry.
+func (storage *Storage) SetURLIndex(hash, id string, expiration time.Duration) error {
+	key := storage.keys.url(hash)
+
+	if err := storage.client.Set(key, id, expiration).Err(); err != nil {
+		errmsg := fmt.Sprintf("Got an unexpected error adding key '%s': %s", key, err)
 
 		logger.Error(errmsg)
 		return errors.Wrap(err, errmsg)
 	}
 
-	if visitor.Expiration > 0 {
-		storage.client.Expire(entryVisitsKey, visitor.Expiration)
+	return nil
+}
+
+// IncreaseCounter atomically increments the named counter and returns its new value, the counter
+// expires after the ttl unless it is increased again. A zero ttl never expires.
+func (storage *Storage) IncreaseCounter(name string, ttl time.Duration) (int64, error) {
+	key := storage.keys.counter(name)
+
+	var value *redis.IntCmd
+	_, err := storage.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		value = pipe.Incr(key)
+		if ttl > 0 {
+			pipe.PExpire(key, ttl)
+		} else {
+			pipe.Persist(key)
+		}
+
+		return nil
+	})
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not increment key '%s': %s", key, err)
+
+		logger.Error(errmsg)
+		return 0, errors.Wrap(err, errmsg)
 	}
 
-	return err
+	return value.Val(), nil
 }
 
-// GetVisitors returns the full list of visitors for a path.
-func (storage *Storage) GetVisitors(id string) ([]shared.Visitor, error) {
-	var visitors []shared.Visitor
+// GetCounter returns the value of the named counter and the time until it expires, a missing counter is zero.
+func (storage *Storage) GetCounter(name string) (int64, time.Duration, error) {
+	key := storage.keys.counter(name)
 
-	// TODO: for non-trivial numbers of keys, this could start
-	// to get hairy; should convert to a paginated Scan operation.
-	result := storage.client.LRange(entryVisitsKeyPrefix+id, 0, -1)
-	if result.Err() != nil {
-		errmsg := fmt.Sprintf("Could not get visitors for id '%s': %s", id, result.Err())
+	var value *redis.StringCmd
+	var ttl *redis.DurationCmd
+	_, err := storage.client.Pipelined(func(pipe redis.Pipeliner) error {
+		value = pipe.Get(key)
+		ttl = pipe.PTTL(key)
+
+		return nil
+	})
+	if err == redis.Nil {
+		return 0, 0, nil
+	}
+
+	if err != nil {
+		errmsg := fmt.Sprintf("Error looking up key '%s': %s'", key, err)
 
 		logger.Error(errmsg)
-		return nil, errors.Wrap(result.Err(), errmsg)
+		return 0, 0, errors.Wrap(err, errmsg)
+	}
+
+	n, err := value.Int64()
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "Could not parse counter '%s'", key)
 	}
 
-	for _, v := range result.Val() {
-		var value shared.Visitor
-		if err := json.Unmarshal([]byte(v), &value); err != nil {
-			errmsg := fmt.Sprintf("Could not unmarshal json for visit '%s': %v", id, err)
+	// counters without a ttl report a negative one
+	if ttl.Val() < 0 {
+		return n, 0, nil
+	}
 
-			logger.Error(errmsg)
-			return nil, errors.Wrap(result.Err(), errmsg)
+	return n, ttl.Val(), nil
+}
+
+// DeleteCounter deletes the named counter.
+func (storage *Storage) DeleteCounter(name string) error {
+	return storage.delValue(storage.keys.counter(name))
+}
+
+// CreateAPIKey stores the api key, it returns shared.ErrEntryAlreadyExist if the id is taken.
+func (storage *Storage) CreateAPIKey(key shared.APIKey) error {
+	raw, err := json.Marshal(key)
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not marshal JSON for api key %s: %v", key.ID, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	return storage.createValue(storage.keys.apiKey(key.ID), raw, 0)
+}
+
+// GetAPIKey returns the api key with the id, or shared.ErrNoEntryFound.
+func (storage *Storage) GetAPIKey(id string) (*shared.APIKey, error) {
+	key := storage.keys.apiKey(id)
+
+	raw, err := storage.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, shared.ErrNoEntryFound
+	}
+
+	if err != nil {
+		errmsg := fmt.Sprintf("Error looking up key '%s': %s'", key, err)
+
+		logger.Error(errmsg)
+		return nil, errors.Wrap(err, errmsg)
+	}
+
+	var apiKey *shared.APIKey
+	if err := json.Unmarshal(raw, &apiKey); err != nil {
+		return nil, errors.Wrapf(err, "Could not unmarshal api key '%s'", id)
+	}
+
+	return apiKey, nil
+}
+
+// GetAPIKeys returns every api key, in no particular order.
+func (storage *Storage) GetAPIKeys() ([]shared.APIKey, error) {
+	pattern := storage.keys.apiKeyPattern()
+
+	var names []string
+	iter := storage.client.Scan(0, pattern, 100).Iterator()
+	for iter.Next() {
+		names = append(names, iter.Val())
+	}
+
+	if err := iter.Err(); err != nil {
+		errmsg := fmt.Sprintf("Could not scan api keys for prefix '%s': %v", pattern, err)
+
+		logger.Error(errmsg)
+		return nil, errors.Wrap(err, errmsg)
+	}
+
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	values, err := storage.client.MGet(names...).Result()
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not fetch api keys for prefix '%s': %v", pattern, err)
+
+		logger.Error(errmsg)
+		return nil, errors.Wrap(err, errmsg)
+	}
+
+	var keys []shared.APIKey
+	for i, name := range names {
+		// the value is nil for keys which were deleted in the meantime
+		raw, ok := values[i].(string)
+		if !ok {
+			continue
+		}
+
+		var key shared.APIKey
+		if err := json.Unmarshal([]byte(raw), &key); err != nil {
+			return nil, errors.Wrapf(err, "Could not unmarshal api key '%s'", name)
 		}
-		visitors = append(visitors, value)
+
+		keys = append(keys, key)
 	}
-	return visitors, nil
+
+	return keys, nil
 }
 
-// IncreaseVisitCounter is a no-op and returns nil for all values.
-//
-// This function is unnecessary for the redis backend: we already
-// have a redis LIST of visitors, and we can derive the visit count
-// by calling redis.client.LLen(list) (which is a constant-time op)
-// during GetEntryByID().  If we want the timestamp of the most recent
-// visit we can pull the most recent visit off with redis.client.LIndex(0)
-// (also constant-time) and reading the timetamp field.
-func (storage *Storage) IncreaseVisitCounter(id string) error {
+// DeleteAPIKey deletes the api key, it returns shared.ErrNoEntryFound if it does not exist.
+func (storage *Storage) DeleteAPIKey(id string) error {
+	key := storage.keys.apiKey(id)
+
+	deleted, err := storage.client.Del(key).Result()
+	if err != nil {
+		errmsg := fmt.Sprintf("Got an unexpected error deleting key '%s': %s", key, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	if deleted == 0 {
+		return errors.Wrapf(shared.ErrNoEntryFound, "Could not delete api key '%s'", id)
+	}
+
 	return nil
 }
 
+// TakeToken takes a token from the bucket of the key, the buckets are shared by every instance using the database.
+func (storage *Storage) TakeToken(key string, limit shared.RateLimit) (shared.RateLimitResult, error) {
+	bucketKey := storage.keys.rateLimit(key)
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+
+	values, err := takeTokenScript.Run(storage.client, []string{bucketKey}, limit.Burst, limit.Rate/1000, now).Result()
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not take a token of key '%s': %s", bucketKey, err)
+
+		logger.Error(errmsg)
+		return shared.RateLimitResult{}, errors.Wrap(err, errmsg)
+	}
+
+	result, ok := values.([]interface{})
+	if !ok || len(result) != 2 {
+		return shared.RateLimitResult{}, errors.Errorf("Unexpected result of the token bucket '%s': %v", bucketKey, values)
+	}
+
+	allowed, _ := result[0].(int64)
+	raw, _ := result[1].(string)
+
+	tokens, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return shared.RateLimitResult{}, errors.Wrapf(err, "Could not parse the tokens of the token bucket '%s'", bucketKey)
+	}
+
+	return limit.Result(tokens, allowed == 1), nil
+}
+
 // Close closes the connection to redis.
 func (storage *Storage) Close() error {
 	err := storage.client.Close()
@@ -0,0 +1,46 @@
+package stores
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrReservedID is returned when a given custom id is reserved, e.g. because it collides with a route
+var ErrReservedID = errors.New("the given ID is reserved")
+
+// reservedIDs is the registry of the ids which can not be used as custom ids
+type reservedIDs struct {
+	mu  sync.RWMutex
+	ids map[string]bool
+}
+
+// newReservedIDs returns a registry which contains the given ids
+func newReservedIDs(ids ...string) *reservedIDs {
+	reserved := &reservedIDs{ids: map[string]bool{}}
+	reserved.add(ids...)
+
+	return reserved
+}
+
+// add reserves the ids, they are compared case-insensitively
+func (reserved *reservedIDs) add(ids ...string) {
+	reserved.mu.Lock()
+	defer reserved.mu.Unlock()
+
+	for _, id := range ids {
+		if id = strings.ToLower(strings.Trim(id, "/")); id != "" {
+			reserved.ids[id] = true
+		}
+	}
+}
+
+// contains reports whether the id or its first path segment is reserved
+func (reserved *reservedIDs) contains(id string) bool {
+	reserved.mu.RLock()
+	defer reserved.mu.RUnlock()
+
+	id = strings.ToLower(strings.TrimPrefix(id, "/"))
+	return reserved.ids[id] || reserved.ids[strings.SplitN(id, "/", 2)[0]]
+}
@@ -3,6 +3,7 @@ package shared
 import (
 	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"time"
 
@@ -26,6 +27,11 @@ func (d *Datetime) UnmarshalJSON(b []byte) (err error) {
 	return
 }
 
+// UnmarshalParam parses a query or form parameter in the default time format
+func (d *Datetime) UnmarshalParam(param string) error {
+	return d.UnmarshalJSON([]byte(param))
+}
+
 func (d *Datetime) MarshalJSON() ([]byte, error) {
 	if d.Time.UnixNano() == (time.Time{}).UnixNano() {
 		return []byte("null"), nil
@@ -38,21 +44,95 @@ func (d *Datetime) MarshalJSON() ([]byte, error) {
 // e.g. bolt, sqlite
 type Storage interface {
 	GetEntryByID(string) (*Entry, error)
-	GetVisitors(string) ([]Visitor, error)
+	GetVisitors(string, VisitorQuery) ([]Visitor, error)
 	DeleteEntry(string) error
-	IncreaseVisitCounter(string) error
 	CreateEntry(Entry, string) error
-	GetEntries() (map[string]Entry, error)
-	RegisterVisitor(string, string, Visitor) error
+	UpdateEntry(string, Entry) error
+	GetEntries(EntryQuery) (map[string]Entry, string, error)
+	RegisterVisitors([]Visit) error
+	NextSequence(string) (uint64, error)
+	GetURLIndex(string) (string, error)
+	SetURLIndex(string, string, time.Duration) error
+	IncreaseCounter(string, time.Duration) (int64, error)
+	GetCounter(string) (int64, time.Duration, error)
+	DeleteCounter(string) error
+	CreateAPIKey(APIKey) error
+	GetAPIKey(string) (*APIKey, error)
+	GetAPIKeys() ([]APIKey, error)
+	DeleteAPIKey(string) error
 	Close() error
 }
 
+// RateLimiter is implemented by the storages which share the rate limits between multiple instances,
+// the store keeps the buckets in memory for the other storages
+type RateLimiter interface {
+	TakeToken(string, RateLimit) (RateLimitResult, error)
+}
+
+// RateLimit is a token bucket, which holds up to Burst tokens and is refilled with Rate tokens per second.
+// Every request takes a token, the zero rate limit allows every request.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitResult is the state of a token bucket after a request
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int           // tokens left for the following requests
+	Reset      time.Duration // time until the bucket is full again
+	RetryAfter time.Duration // time until the next token, if the request is not allowed
+}
+
+// Result returns the result of a request which left the tokens in the bucket
+func (limit RateLimit) Result(tokens float64, allowed bool) RateLimitResult {
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second)),
+	}
+
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+
+	return result
+}
+
+// EntryQuery selects a page of entries, an empty cursor starts the listing from the beginning and
+// a zero or negative limit selects every entry after the cursor, like the limit of a VisitorQuery.
+// Entries of the owner or of the team are selected, the entries of everyone if both are empty.
+type EntryQuery struct {
+	Cursor string
+	Limit  int
+	Owner  string
+	Team   string
+}
+
+// Full reports whether a page with n entries reaches the limit of the query
+func (query EntryQuery) Full(n int) bool {
+	return query.Limit > 0 && n >= query.Limit
+}
+
+// Matches reports whether the query selects the entry, regardless of the cursor
+func (query EntryQuery) Matches(entry *Entry) bool {
+	if query.Owner == "" && query.Team == "" {
+		return true
+	}
+
+	return (query.Owner != "" && entry.Owner == query.Owner) || (query.Team != "" && entry.Team == query.Team)
+}
+
 // Entry is the data set which is stored in the DB as JSON
 type Entry struct {
 	RemoteAddr  string          `json:"remote_addr,omitempty"`
 	DeletionURL string          `json:"deletion_url,omitempty"`
 	Password    []byte          `json:"password,omitempty"`
+	Owner       string          `json:"owner,omitempty"`
+	Team        string          `json:"team,omitempty"`
 	Public      EntryPublicData `json:"public"`
+	// RetainUntil keeps the expired entry in the storage until this time, nil removes it when it expires
+	RetainUntil *Datetime `json:"retain_until,omitempty"`
 }
 
 // GetExpiration calculate the difference by expiration time
@@ -70,13 +150,108 @@ func (entry *Entry) GetExpiration() time.Duration {
 	return expiration
 }
 
+// IsExpired reports whether the expiration time of the entry has passed
+func (entry *Entry) IsExpired() bool {
+	if entry.Public.Expiration == nil || entry.Public.Expiration.IsZero() {
+		return false
+	}
+
+	return entry.Public.Expiration.Before(time.Now())
+}
+
+// IsPending reports whether the entry is not valid yet
+func (entry *Entry) IsPending() bool {
+	if entry.Public.ValidFrom == nil || entry.Public.ValidFrom.IsZero() {
+		return false
+	}
+
+	return entry.Public.ValidFrom.After(time.Now())
+}
+
+// RemovalTime returns the point in time the entry is removed from the storage, nil keeps it forever
+func (entry *Entry) RemovalTime() *Datetime {
+	if entry.Public.Expiration == nil || entry.Public.Expiration.IsZero() {
+		return nil
+	}
+
+	if entry.RetainUntil != nil && entry.RetainUntil.After(entry.Public.Expiration.Time) {
+		return entry.RetainUntil
+	}
+
+	return entry.Public.Expiration
+}
+
+// GetRetention calculates the duration until the entry is removed from the storage, like GetExpiration
+func (entry *Entry) GetRetention() time.Duration {
+	removal := entry.RemovalTime()
+	if removal == nil {
+		return 0
+	}
+
+	retention := time.Until(removal.Time)
+	if retention < defaultExpiration {
+		retention = defaultExpiration
+	}
+
+	return retention
+}
+
+// IsRemoved reports whether the entry has expired and its retention has passed as well
+func (entry *Entry) IsRemoved() bool {
+	removal := entry.RemovalTime()
+	return removal != nil && removal.Before(time.Now())
+}
+
 // EntryPublicData is the public part of an entry
 type EntryPublicData struct {
 	CreatedOn  *Datetime `json:"created_on"`
 	LastVisit  *Datetime `json:"last_visit,omitempty"`
 	Expiration *Datetime `json:"expiration,omitempty"`
+	ValidFrom  *Datetime `json:"valid_from,omitempty"`
 	VisitCount int       `json:"visit_count"`
 	URL        string    `json:"url"`
+	// RedirectType is the status code of the redirect, zero uses the configured default
+	RedirectType int `json:"redirect_type,omitempty"`
+	// Interstitial shows the preview page before every redirect
+	Interstitial bool `json:"interstitial,omitempty"`
+	// Expired is set on the expired entries which are retained, it is not stored
+	Expired bool `json:"expired,omitempty"`
+	// MaxVisits limits the number of redirects to the URL, zero is unlimited
+	MaxVisits int `json:"max_visits,omitempty"`
+	// RemainingVisits is set on the entries with MaxVisits, it is not stored
+	RemainingVisits *int `json:"remaining_visits,omitempty"`
+}
+
+// The scopes of the api keys, the admin scope includes the others and grants access to the entries of every owner
+const (
+	ScopeCreate = "create"
+	ScopeRead   = "read"
+	ScopeAdmin  = "admin"
+)
+
+// APIKey authenticates the requests of an owner to the api, only the hash of its secret is stored
+type APIKey struct {
+	ID        string    `json:"id"`
+	Hash      []byte    `json:"hash"`
+	Owner     string    `json:"owner"`
+	Scopes    []string  `json:"scopes"`
+	CreatedOn *Datetime `json:"created_on"`
+}
+
+// HasScope reports whether the key grants the scope
+func (key *APIKey) HasScope(scope string) bool {
+	return HasScope(key.Scopes, scope)
+}
+
+// HasScope reports whether the scopes grant the scope
+func HasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+
+	return false
 }
 
 // Visitor is the entry which is stored in the visitors bucket
@@ -90,10 +265,66 @@ type Visitor struct {
 	UTMCampaign string    `json:"utm_campaign,omitempty"`
 	UTMContent  string    `json:"utm_content,omitempty"`
 	UTMTerm     string    `json:"utm_term,omitempty"`
+}
+
+// Visit is a visitor of an entry, visits are registered in batches. The visits of entries which
+// do not exist (anymore) are skipped, so the visit count is derived from the visits in every storage.
+type Visit struct {
+	EntryID string
+	Visitor Visitor
+}
+
+// VisitorQuery selects a range of the visitors of an entry, ordered by the most recent visit first.
+// Zero times leave the time range open and a zero limit selects every visitor after the offset.
+type VisitorQuery struct {
+	Offset int
+	Limit  int
+	From   time.Time
+	To     time.Time
+}
 
-	Expiration time.Duration `json:"-"`
+// VisitorCollector gathers the visitors selected by a query from visitors which are
+// offered with the most recent visit first
+type VisitorCollector struct {
+	Visitors []Visitor
+
+	query   VisitorQuery
+	skipped int
+}
+
+// NewVisitorCollector returns an empty collector for the query
+func NewVisitorCollector(query VisitorQuery) *VisitorCollector {
+	return &VisitorCollector{query: query}
+}
+
+// Add offers the next visitor and reports whether the collection is complete,
+// either because the limit is reached or the visitor is older than the time range
+func (collector *VisitorCollector) Add(visitor Visitor) bool {
+	var timestamp time.Time
+	if visitor.Timestamp != nil {
+		timestamp = visitor.Timestamp.Time
+	}
+
+	if !collector.query.From.IsZero() && timestamp.Before(collector.query.From) {
+		return true
+	}
+
+	if !collector.query.To.IsZero() && timestamp.After(collector.query.To) {
+		return false
+	}
+
+	if collector.skipped < collector.query.Offset {
+		collector.skipped++
+		return false
+	}
+
+	collector.Visitors = append(collector.Visitors, visitor)
+	return collector.query.Limit > 0 && len(collector.Visitors) >= collector.query.Limit
 }
 
 // ErrNoEntryFound is returned when no entry to a id is found
 var ErrNoEntryFound = errors.New("no entry found with this ID")
 var ErrEntryAlreadyExist = errors.New("already exists")
+
+// ErrInvalidCursor is returned when a listing cursor was not issued by the storage
+var ErrInvalidCursor = errors.New("invalid cursor")
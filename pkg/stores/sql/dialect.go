@@ -0,0 +1,131 @@
+package sql
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	// database drivers for the supported dialects
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// dialect holds the differences between the supported databases
+type dialect struct {
+	name          string
+	serialType    string // type of auto incremented primary keys
+	blobType      string // type of raw binary data
+	timestampType string // type of points in time
+	maxOpenConns  int    // upper bound of open connections, 0 means unlimited
+	numbered      bool   // whether placeholders are numbered ($1, $2) instead of plain question marks
+	// lockStatement and unlockStatement serialize the schema migrations of concurrently started instances,
+	// they are empty if the database is not shared between hosts
+	lockStatement   string
+	unlockStatement string
+}
+
+// migrationLockID is the key of the postgres advisory lock which is held while the schema is migrated
+const migrationLockID = 7253011
+
+var dialects = map[string]dialect{
+	"sqlite3": {
+		name:          "sqlite3",
+		serialType:    "INTEGER PRIMARY KEY AUTOINCREMENT",
+		blobType:      "BLOB",
+		timestampType: "TIMESTAMP",
+		// sqlite allows only one writer at a time, sharing a single connection avoids "database is locked" errors
+		maxOpenConns: 1,
+	},
+	"postgres": {
+		name:            "postgres",
+		serialType:      "BIGSERIAL PRIMARY KEY",
+		blobType:        "BYTEA",
+		timestampType:   "TIMESTAMP WITH TIME ZONE",
+		numbered:        true,
+		lockStatement:   "SELECT pg_advisory_lock(" + strconv.Itoa(migrationLockID) + ")",
+		unlockStatement: "SELECT pg_advisory_unlock(" + strconv.Itoa(migrationLockID) + ")",
+	},
+}
+
+// getDialect returns the dialect which is registered with the name
+func getDialect(name string) (dialect, error) {
+	d, ok := dialects[name]
+	if !ok {
+		return dialect{}, errors.New(name + " is not a supported sql dialect")
+	}
+
+	return d, nil
+}
+
+// rebind replaces the question mark placeholders of the query with the ones of the dialect
+func (d dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+
+	var (
+		buf strings.Builder
+		n   int
+	)
+
+	for _, r := range query {
+		if r != '?' {
+			buf.WriteRune(r)
+			continue
+		}
+
+		n++
+		buf.WriteString("$" + strconv.Itoa(n))
+	}
+
+	return buf.String()
+}
+
+// timestamp is a nullable point in time which can be scanned from every dialect,
+// sqlite returns aggregated timestamps as text instead of time.Time
+type timestamp struct {
+	time.Time
+	Valid bool
+}
+
+// the formats sqlite uses for storing timestamps as text
+var timestampFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// Scan implements the sql.Scanner interface
+func (t *timestamp) Scan(value interface{}) error {
+	t.Time, t.Valid = time.Time{}, false
+
+	var str string
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		t.Time, t.Valid = v, true
+		return nil
+	case []byte:
+		str = string(v)
+	case string:
+		str = v
+	default:
+		return errors.Errorf("could not scan %T into a timestamp", value)
+	}
+
+	str = strings.TrimSuffix(str, "Z")
+	for _, format := range timestampFormats {
+		if parsed, err := time.ParseInLocation(format, str, time.UTC); err == nil {
+			t.Time, t.Valid = parsed, true
+			return nil
+		}
+	}
+
+	return errors.Errorf("could not parse timestamp '%s'", str)
+}
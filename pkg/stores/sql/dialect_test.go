@@ -0,0 +1,49 @@
+package sql
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRebind(t *testing.T) {
+	query := `SELECT id FROM entries WHERE owner = ? AND (team = ? OR id > ?)`
+
+	if got := dialects["sqlite3"].rebind(query); got != query {
+		t.Errorf("expected the query to be kept, got %q", got)
+	}
+
+	want := `SELECT id FROM entries WHERE owner = $1 AND (team = $2 OR id > $3)`
+	if got := dialects["postgres"].rebind(query); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestTimestampScan(t *testing.T) {
+	want := time.Date(2019, 7, 16, 5, 56, 9, 0, time.UTC)
+
+	for _, value := range []interface{}{
+		want,
+		want.In(time.FixedZone("CEST", 2*60*60)),
+		"2019-07-16 05:56:09",
+		"2019-07-16T05:56:09Z",
+		"2019-07-16 05:56:09+00:00",
+		"2019-07-16 07:56:09+02:00",
+		[]byte("2019-07-16 05:56:09.000"),
+	} {
+		var ts timestamp
+		if err := ts.Scan(value); err != nil || !ts.Valid || !ts.Equal(want) {
+			t.Errorf("expected %v to be scanned as %v, got %v, %v, %v", value, want, ts.Time, ts.Valid, err)
+		}
+	}
+
+	var ts timestamp
+	if err := ts.Scan(nil); err != nil || ts.Valid {
+		t.Errorf("expected NULL to be scanned as an invalid timestamp, got %v, %v", ts.Valid, err)
+	}
+
+	for _, value := range []interface{}{"yesterday", 42} {
+		if err := ts.Scan(value); err == nil || ts.Valid {
+			t.Errorf("expected %v to be rejected, got %v", value, ts.Time)
+		}
+	}
+}
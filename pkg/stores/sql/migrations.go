@@ -0,0 +1,238 @@
+package sql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/logger"
+)
+
+// migration is a versioned change of the schema, the statements are generated for the dialect in use
+type migration struct {
+	version     int
+	description string
+	statements  func(d dialect) []string
+}
+
+// migrations must only ever be appended, every released version is applied exactly once
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create entries and visits",
+		statements: func(d dialect) []string {
+			return []string{
+				fmt.Sprintf(`CREATE TABLE entries (
+					id          VARCHAR(255) NOT NULL PRIMARY KEY,
+					url         TEXT         NOT NULL,
+					password    %s,
+					remote_addr VARCHAR(255) NOT NULL DEFAULT '',
+					created_on  %s           NOT NULL,
+					expiration  %s
+				)`, d.blobType, d.timestampType, d.timestampType),
+				`CREATE INDEX entries_expiration_idx ON entries (expiration)`,
+				fmt.Sprintf(`CREATE TABLE visits (
+					id           %s,
+					entry_id     VARCHAR(255) NOT NULL,
+					ip           VARCHAR(255) NOT NULL DEFAULT '',
+					referer      TEXT         NOT NULL DEFAULT '',
+					user_agent   TEXT         NOT NULL DEFAULT '',
+					utm_source   TEXT         NOT NULL DEFAULT '',
+					utm_medium   TEXT         NOT NULL DEFAULT '',
+					utm_campaign TEXT         NOT NULL DEFAULT '',
+					utm_content  TEXT         NOT NULL DEFAULT '',
+					utm_term     TEXT         NOT NULL DEFAULT '',
+					visited_on   %s           NOT NULL
+				)`, d.serialType, d.timestampType),
+				`CREATE INDEX visits_entry_id_visited_on_idx ON visits (entry_id, visited_on)`,
+			}
+		},
+	},
+	{
+		version:     2,
+		description: "create sequences",
+		statements: func(d dialect) []string {
+			return []string{
+				`CREATE TABLE sequences (
+					name  VARCHAR(255) NOT NULL PRIMARY KEY,
+					value BIGINT       NOT NULL
+				)`,
+			}
+		},
+	},
+	{
+		version:     3,
+		description: "create url index",
+		statements: func(d dialect) []string {
+			return []string{
+				`CREATE TABLE url_index (
+					url_hash VARCHAR(255) NOT NULL PRIMARY KEY,
+					entry_id VARCHAR(255) NOT NULL
+				)`,
+				`CREATE INDEX url_index_entry_id_idx ON url_index (entry_id)`,
+			}
+		},
+	},
+	{
+		version:     4,
+		description: "create counters",
+		statements: func(d dialect) []string {
+			return []string{
+				fmt.Sprintf(`CREATE TABLE counters (
+					name       VARCHAR(255) NOT NULL PRIMARY KEY,
+					value      BIGINT       NOT NULL,
+					expiration %s
+				)`, d.timestampType),
+				`CREATE INDEX counters_expiration_idx ON counters (expiration)`,
+			}
+		},
+	},
+	{
+		version:     5,
+		description: "add redirect type of entries",
+		statements: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE entries ADD COLUMN redirect_type INTEGER NOT NULL DEFAULT 0`,
+			}
+		},
+	},
+	{
+		version:     6,
+		description: "add interstitial flag of entries",
+		statements: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE entries ADD COLUMN interstitial BOOLEAN NOT NULL DEFAULT FALSE`,
+			}
+		},
+	},
+	{
+		version:     7,
+		description: "retain expired entries",
+		statements: func(d dialect) []string {
+			return []string{
+				fmt.Sprintf(`ALTER TABLE entries ADD COLUMN retain_until %s`, d.timestampType),
+				`UPDATE entries SET retain_until = expiration`,
+				`CREATE INDEX entries_retain_until_idx ON entries (retain_until)`,
+			}
+		},
+	},
+	{
+		version:     8,
+		description: "add visit limit of entries",
+		statements: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE entries ADD COLUMN max_visits INTEGER NOT NULL DEFAULT 0`,
+			}
+		},
+	},
+	{
+		version:     9,
+		description: "add valid from time of entries",
+		statements: func(d dialect) []string {
+			return []string{
+				fmt.Sprintf(`ALTER TABLE entries ADD COLUMN valid_from %s`, d.timestampType),
+			}
+		},
+	},
+	{
+		version:     10,
+		description: "add owner of entries and create api keys",
+		statements: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE entries ADD COLUMN owner VARCHAR(255) NOT NULL DEFAULT ''`,
+				`CREATE INDEX entries_owner_idx ON entries (owner, id)`,
+				fmt.Sprintf(`CREATE TABLE api_keys (
+					id         VARCHAR(255) NOT NULL PRIMARY KEY,
+					hash       %s           NOT NULL,
+					owner      VARCHAR(255) NOT NULL,
+					scopes     VARCHAR(255) NOT NULL,
+					created_on %s           NOT NULL
+				)`, d.blobType, d.timestampType),
+			}
+		},
+	},
+	{
+		version:     11,
+		description: "add team of entries",
+		statements: func(d dialect) []string {
+			return []string{
+				`ALTER TABLE entries ADD COLUMN team VARCHAR(255) NOT NULL DEFAULT ''`,
+				`CREATE INDEX entries_team_idx ON entries (team, id)`,
+			}
+		},
+	},
+}
+
+// migrate applies every migration which is newer than the current schema version. The migrations run on a
+// single connection, which holds the lock of the dialect, so concurrently started instances apply them once.
+func migrate(db *sql.DB, d dialect) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Could not get a connection for the schema migrations")
+	}
+	defer conn.Close()
+
+	if d.lockStatement != "" {
+		if _, err := conn.ExecContext(ctx, d.lockStatement); err != nil {
+			return errors.Wrap(err, "Could not lock the schema migrations")
+		}
+
+		defer func() {
+			if _, err := conn.ExecContext(ctx, d.unlockStatement); err != nil {
+				logger.Errorf("Could not unlock the schema migrations: %v", err)
+			}
+		}()
+	}
+
+	_, err = conn.ExecContext(ctx, fmt.Sprintf(
+		`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL PRIMARY KEY, applied_on %s NOT NULL)`,
+		d.timestampType,
+	))
+	if err != nil {
+		return errors.Wrap(err, "Could not create the schema_migrations table")
+	}
+
+	var current int
+	if err := conn.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return errors.Wrap(err, "Could not read the schema version")
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		logger.Infof("Applying schema migration %d: %s", m.version, m.description)
+		if err := apply(ctx, conn, d, m); err != nil {
+			return errors.Wrapf(err, "Could not apply schema migration %d", m.version)
+		}
+	}
+
+	return nil
+}
+
+// apply runs the statements of the migration and records its version in a single transaction
+func apply(ctx context.Context, conn *sql.Conn, d dialect, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range m.statements(d) {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(d.rebind(`INSERT INTO schema_migrations (version, applied_on) VALUES (?, ?)`), m.version, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,49 @@
+package sql
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := sql.Open("sqlite3", tempDSN(dir, 0))
+	if err != nil {
+		t.Fatalf("could not open db: %v", err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := migrate(db, dialects["sqlite3"]); err != nil {
+			t.Fatalf("could not migrate the schema (run %d): %v", i+1, err)
+		}
+
+		var count, version int
+		if err := db.QueryRow(`SELECT COUNT(*), MAX(version) FROM schema_migrations`).Scan(&count, &version); err != nil {
+			t.Fatalf("could not read the schema version: %v", err)
+		}
+
+		if latest := migrations[len(migrations)-1].version; count != len(migrations) || version != latest {
+			t.Errorf("expected %d applied migrations up to version %d, got %d up to %d", len(migrations), latest, count, version)
+		}
+	}
+
+	for _, table := range []string{"entries", "visits", "sequences", "url_index", "counters", "api_keys"} {
+		if _, err := db.Exec(`SELECT COUNT(*) FROM ` + table); err != nil {
+			t.Errorf("expected the table %s to exist: %v", table, err)
+		}
+	}
+
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("expected the migrations to be numbered consecutively, got version %d at %d", m.version, i)
+		}
+	}
+}
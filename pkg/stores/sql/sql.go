@@ -0,0 +1,710 @@
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// entryColumns are the selected columns of an entry followed by its visit statistics, see scanEntry
+const entryColumns = `e.id, e.url, e.password, e.remote_addr, e.owner, e.team, e.created_on, e.expiration, e.retain_until, e.valid_from, e.redirect_type, e.interstitial, e.max_visits, COUNT(v.id), MAX(v.visited_on)`
+
+// Storage implements the shared.Storage interface
+type Storage struct {
+	db      *sql.DB
+	dialect dialect
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// New opens the database, applies the pending schema migrations and starts the sweeping of expired entries.
+func New(dialectName, dsn string, sweepInterval string) (*Storage, error) {
+	d, err := getDialect(dialectName)
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := time.ParseDuration(sweepInterval)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not parse sweep interval")
+	}
+
+	db, err := sql.Open(d.name, dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not open %s db", d.name)
+	}
+	db.SetMaxOpenConns(d.maxOpenConns)
+
+	// if we can't talk to the database, fail fast
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "Could not connect to %s db", d.name)
+	}
+
+	if err := migrate(db, d); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	storage := &Storage{db: db, dialect: d, stop: make(chan struct{}), done: make(chan struct{})}
+	go storage.sweep(interval)
+
+	return storage, nil
+}
+
+// sweep periodically removes the expired entries and their visits until the storage is closed.
+func (storage *Storage) sweep(interval time.Duration) {
+	defer close(storage.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-storage.stop:
+			return
+		case <-ticker.C:
+			if err := storage.removeExpiredEntries(); err != nil {
+				logger.Errorf("Could not sweep expired entries: %v", err)
+			}
+		}
+	}
+}
+
+// removeExpiredEntries deletes every entry whose expiration time and retention have passed.
+func (storage *Storage) removeExpiredEntries() error {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Could not begin transaction")
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	_, err = tx.Exec(storage.dialect.rebind(
+		`DELETE FROM visits WHERE entry_id IN (SELECT id FROM entries WHERE retain_until < ?)`,
+	), now)
+	if err != nil {
+		return errors.Wrap(err, "Could not delete visits of expired entries")
+	}
+
+	_, err = tx.Exec(storage.dialect.rebind(
+		`DELETE FROM url_index WHERE entry_id IN (SELECT id FROM entries WHERE retain_until < ?)`,
+	), now)
+	if err != nil {
+		return errors.Wrap(err, "Could not delete url hashes of expired entries")
+	}
+
+	result, err := tx.Exec(storage.dialect.rebind(`DELETE FROM entries WHERE retain_until < ?`), now)
+	if err != nil {
+		return errors.Wrap(err, "Could not delete expired entries")
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n > 0 {
+		logger.Debugf("Swept %d expired entries", n)
+	}
+
+	if _, err := tx.Exec(storage.dialect.rebind(`DELETE FROM counters WHERE expiration < ?`), now); err != nil {
+		return errors.Wrap(err, "Could not delete expired counters")
+	}
+
+	return errors.Wrap(tx.Commit(), "Could not commit transaction")
+}
+
+// scanEntry scans a row selected with entryColumns into an entry and returns its id
+func scanEntry(scanner interface{ Scan(...interface{}) error }) (string, *shared.Entry, error) {
+	var (
+		id                     string
+		entry                  shared.Entry
+		createdOn, expiration  timestamp
+		retainUntil, validFrom timestamp
+		lastVisit              timestamp
+	)
+
+	err := scanner.Scan(
+		&id, &entry.Public.URL, &entry.Password, &entry.RemoteAddr, &entry.Owner, &entry.Team,
+		&createdOn, &expiration, &retainUntil, &validFrom, &entry.Public.RedirectType, &entry.Public.Interstitial, &entry.Public.MaxVisits,
+		&entry.Public.VisitCount, &lastVisit,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	entry.Public.CreatedOn = &shared.Datetime{Time: createdOn.Local()}
+	if expiration.Valid {
+		entry.Public.Expiration = &shared.Datetime{Time: expiration.Local()}
+	}
+
+	if retainUntil.Valid {
+		entry.RetainUntil = &shared.Datetime{Time: retainUntil.Local()}
+	}
+
+	if validFrom.Valid {
+		entry.Public.ValidFrom = &shared.Datetime{Time: validFrom.Local()}
+	}
+
+	// default to start-of-epoch if nobody has visited yet
+	entry.Public.LastVisit = &shared.Datetime{Time: time.Unix(0, 0)}
+	if lastVisit.Valid {
+		entry.Public.LastVisit = &shared.Datetime{Time: lastVisit.Local()}
+	}
+
+	return id, &entry, nil
+}
+
+// CreateEntry creates an entry (path->url mapping), it returns shared.ErrEntryAlreadyExist if the id is taken.
+func (storage *Storage) CreateEntry(entry shared.Entry, id string) error {
+	logger.Debugf("Creating entry '%s'", id)
+
+	expiration := expirationValue(entry)
+
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Could not begin transaction")
+	}
+	defer tx.Rollback()
+
+	// an expired entry which has not been swept yet is replaced together with its visits
+	now := time.Now().UTC()
+	_, err = tx.Exec(storage.dialect.rebind(
+		`DELETE FROM visits WHERE entry_id IN (SELECT id FROM entries WHERE id = ? AND retain_until < ?)`,
+	), id, now)
+	if err != nil {
+		return errors.Wrapf(err, "Could not delete visits of expired entry '%s'", id)
+	}
+
+	if _, err = tx.Exec(storage.dialect.rebind(`DELETE FROM entries WHERE id = ? AND retain_until < ?`), id, now); err != nil {
+		return errors.Wrapf(err, "Could not delete expired entry '%s'", id)
+	}
+
+	_, err = tx.Exec(storage.dialect.rebind(
+		`INSERT INTO entries (id, url, password, remote_addr, owner, team, created_on, expiration, retain_until, valid_from,
+			redirect_type, interstitial, max_visits)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	), id, entry.Public.URL, entry.Password, entry.RemoteAddr, entry.Owner, entry.Team, entry.Public.CreatedOn.UTC(), expiration, removalValue(entry),
+		validFromValue(entry), entry.Public.RedirectType, entry.Public.Interstitial, entry.Public.MaxVisits)
+	if err != nil {
+		// the transaction is unusable after a failed statement, so the existence is checked outside of it
+		tx.Rollback()
+
+		var exists int
+		if storage.db.QueryRow(storage.dialect.rebind(`SELECT COUNT(*) FROM entries WHERE id = ?`), id).Scan(&exists) == nil && exists > 0 {
+			return errors.Wrapf(shared.ErrEntryAlreadyExist, "Could not create entry '%s'", id)
+		}
+
+		errmsg := fmt.Sprintf("Could not insert entry '%s': %v", id, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	return errors.Wrap(tx.Commit(), "Could not commit transaction")
+}
+
+// UpdateEntry replaces the url, the password, the expiration and the options of an existing entry, it
+// returns shared.ErrNoEntryFound if the entry is gone. The visits are kept.
+func (storage *Storage) UpdateEntry(id string, entry shared.Entry) error {
+	logger.Debugf("Updating entry '%s'", id)
+
+	result, err := storage.db.Exec(storage.dialect.rebind(
+		`UPDATE entries SET url = ?, password = ?, expiration = ?, retain_until = ?, valid_from = ?,
+			redirect_type = ?, interstitial = ?, max_visits = ?
+		WHERE id = ? AND (retain_until IS NULL OR retain_until >= ?)`,
+	), entry.Public.URL, entry.Password, expirationValue(entry), removalValue(entry), validFromValue(entry),
+		entry.Public.RedirectType, entry.Public.Interstitial, entry.Public.MaxVisits, id, time.Now().UTC())
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not update entry '%s': %v", id, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.Wrapf(shared.ErrNoEntryFound, "Could not update entry '%s'", id)
+	}
+
+	return nil
+}
+
+// expirationValue returns the expiration of the entry in UTC, or nil if it never expires
+func expirationValue(entry shared.Entry) interface{} {
+	if entry.Public.Expiration == nil || entry.Public.Expiration.IsZero() {
+		return nil
+	}
+
+	return entry.Public.Expiration.UTC()
+}
+
+// validFromValue returns the valid from time of the entry in UTC, or nil if it is valid immediately
+func validFromValue(entry shared.Entry) interface{} {
+	if entry.Public.ValidFrom == nil || entry.Public.ValidFrom.IsZero() {
+		return nil
+	}
+
+	return entry.Public.ValidFrom.UTC()
+}
+
+// removalValue returns the point in time the entry is removed in UTC, or nil if it is kept forever
+func removalValue(entry shared.Entry) interface{} {
+	if removal := entry.RemovalTime(); removal != nil {
+		return removal.UTC()
+	}
+
+	return nil
+}
+
+// DeleteEntry deletes an entry and all associated stored data.
+func (storage *Storage) DeleteEntry(id string) error {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Could not begin transaction")
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(storage.dialect.rebind(`DELETE FROM visits WHERE entry_id = ?`), id); err != nil {
+		return errors.Wrapf(err, "Could not delete visits for id %s", id)
+	}
+
+	if _, err := tx.Exec(storage.dialect.rebind(`DELETE FROM url_index WHERE entry_id = ?`), id); err != nil {
+		return errors.Wrapf(err, "Could not delete url hashes for id %s", id)
+	}
+
+	result, err := tx.Exec(storage.dialect.rebind(`DELETE FROM entries WHERE id = ?`), id)
+	if err != nil {
+		return errors.Wrapf(err, "Could not delete entry id %s", id)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		logger.Warnf("Tried to delete entry '%s' but it's already gone", id)
+	}
+
+	return errors.Wrap(tx.Commit(), "Could not commit transaction")
+}
+
+// GetEntryByID looks up an entry by its path and returns a pointer to a
+// shared.Entry instance, with the visit count and last visit time set
+// properly.
+func (storage *Storage) GetEntryByID(id string) (*shared.Entry, error) {
+	row := storage.db.QueryRow(storage.dialect.rebind(
+		`SELECT `+entryColumns+` FROM entries e LEFT JOIN visits v ON v.entry_id = e.id
+		WHERE e.id = ? AND (e.retain_until IS NULL OR e.retain_until >= ?)
+		GROUP BY e.id`,
+	), id, time.Now().UTC())
+
+	_, entry, err := scanEntry(row)
+	if err == sql.ErrNoRows {
+		return nil, shared.ErrNoEntryFound
+	}
+
+	if err != nil {
+		errmsg := fmt.Sprintf("Error looking up entry '%s': %v", id, err)
+
+		logger.Error(errmsg)
+		return nil, errors.Wrap(err, errmsg)
+	}
+
+	return entry, nil
+}
+
+// GetEntries returns a page of entries, in the form of a map of path->shared.Entry, and the
+// cursor of the following page. The cursor is the last id of the page, entries are ordered by
+// their id and the cursor is empty on the last page.
+func (storage *Storage) GetEntries(query shared.EntryQuery) (map[string]shared.Entry, string, error) {
+	entries := map[string]shared.Entry{}
+
+	conditions, args := `e.id > ? AND (e.retain_until IS NULL OR e.retain_until >= ?)`, []interface{}{query.Cursor, time.Now().UTC()}
+	switch {
+	case query.Owner != "" && query.Team != "":
+		conditions += ` AND (e.owner = ? OR e.team = ?)`
+		args = append(args, query.Owner, query.Team)
+	case query.Owner != "":
+		conditions += ` AND e.owner = ?`
+		args = append(args, query.Owner)
+	case query.Team != "":
+		conditions += ` AND e.team = ?`
+		args = append(args, query.Team)
+	}
+
+	// one more entry than requested tells whether there is a following page
+	limit := query.Limit + 1
+	if query.Limit <= 0 {
+		limit = math.MaxInt32
+	}
+
+	rows, err := storage.db.Query(storage.dialect.rebind(
+		`SELECT `+entryColumns+` FROM entries e LEFT JOIN visits v ON v.entry_id = e.id
+		WHERE `+conditions+`
+		GROUP BY e.id ORDER BY e.id LIMIT ?`,
+	), append(args, limit)...)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Could not query entries")
+	}
+	defer rows.Close()
+
+	lastID, nextCursor := "", ""
+	for rows.Next() {
+		if query.Full(len(entries)) {
+			nextCursor = lastID
+			break
+		}
+
+		id, entry, err := scanEntry(rows)
+		if err != nil {
+			return nil, "", errors.Wrap(err, "Could not scan entry")
+		}
+
+		entries[id] = *entry
+		lastID = id
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, "", errors.Wrap(err, "Could not iterate over the entries")
+	}
+
+	return entries, nextCursor, nil
+}
+
+// RegisterVisitors adds the visits to the visits of their entries, in one transaction.
+//
+// The visits are removed together with the entry, so the expiration of the visitors is not needed.
+func (storage *Storage) RegisterVisitors(visits []shared.Visit) error {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return errors.Wrap(err, "Could not begin transaction")
+	}
+	defer tx.Rollback()
+
+	insert, err := tx.Prepare(storage.dialect.rebind(
+		`INSERT INTO visits (entry_id, ip, referer, user_agent, utm_source, utm_medium, utm_campaign, utm_content, utm_term, visited_on)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+	))
+	if err != nil {
+		return errors.Wrap(err, "Could not prepare the insertion of visits")
+	}
+	defer insert.Close()
+
+	exists := map[string]bool{}
+	for _, visit := range visits {
+		id, visitor := visit.EntryID, visit.Visitor
+
+		found, ok := exists[id]
+		if !ok {
+			var count int
+			if err := tx.QueryRow(storage.dialect.rebind(`SELECT COUNT(*) FROM entries WHERE id = ?`), id).Scan(&count); err != nil {
+				return errors.Wrapf(err, "Could not look up entry '%s'", id)
+			}
+
+			found, exists[id] = count > 0, count > 0
+		}
+
+		if !found {
+			logger.Debugf("Skip the visit of the missing entry '%s'", id)
+			continue
+		}
+
+		_, err := insert.Exec(id, visitor.IP, visitor.Referer, visitor.UserAgent, visitor.UTMSource, visitor.UTMMedium,
+			visitor.UTMCampaign, visitor.UTMContent, visitor.UTMTerm, visitor.Timestamp.UTC())
+		if err != nil {
+			errmsg := fmt.Sprintf("Could not register visitor for ID %s: %s", id, err)
+
+			logger.Error(errmsg)
+			return errors.Wrap(err, errmsg)
+		}
+	}
+
+	return errors.Wrap(tx.Commit(), "Could not commit transaction")
+}
+
+// GetVisitors returns the visitors for a path which are selected by the query, the most recent visit first.
+func (storage *Storage) GetVisitors(id string, query shared.VisitorQuery) ([]shared.Visitor, error) {
+	var visitors []shared.Visitor
+
+	conditions, args := `entry_id = ?`, []interface{}{id}
+	if !query.From.IsZero() {
+		conditions += ` AND visited_on >= ?`
+		args = append(args, query.From.UTC())
+	}
+
+	if !query.To.IsZero() {
+		conditions += ` AND visited_on <= ?`
+		args = append(args, query.To.UTC())
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = math.MaxInt32
+	}
+
+	rows, err := storage.db.Query(storage.dialect.rebind(
+		`SELECT ip, referer, user_agent, utm_source, utm_medium, utm_campaign, utm_content, utm_term, visited_on
+		FROM visits WHERE `+conditions+` ORDER BY visited_on DESC, id DESC LIMIT ? OFFSET ?`,
+	), append(args, limit, query.Offset)...)
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not get visitors for id '%s': %s", id, err)
+
+		logger.Error(errmsg)
+		return nil, errors.Wrap(err, errmsg)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			value     shared.Visitor
+			visitedOn timestamp
+		)
+
+		err := rows.Scan(
+			&value.IP, &value.Referer, &value.UserAgent, &value.UTMSource, &value.UTMMedium,
+			&value.UTMCampaign, &value.UTMContent, &value.UTMTerm, &visitedOn,
+		)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Could not scan visit for id '%s'", id)
+		}
+
+		value.Timestamp = &shared.Datetime{Time: visitedOn.Local()}
+		visitors = append(visitors, value)
+	}
+
+	return visitors, errors.Wrap(rows.Err(), "Could not iterate over the visits")
+}
+
+// NextSequence increments the named counter and returns its new value, the first value is 1.
+// The row of the counter is locked by the update until the transaction ends, so concurrent
+// increments never return the same value.
+func (storage *Storage) NextSequence(name string) (uint64, error) {
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not begin transaction")
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(storage.dialect.rebind(`INSERT INTO sequences (name, value) VALUES (?, 0) ON CONFLICT (name) DO NOTHING`), name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not create sequence '%s'", name)
+	}
+
+	if _, err := tx.Exec(storage.dialect.rebind(`UPDATE sequences SET value = value + 1 WHERE name = ?`), name); err != nil {
+		return 0, errors.Wrapf(err, "Could not increment sequence '%s'", name)
+	}
+
+	var value uint64
+	if err := tx.QueryRow(storage.dialect.rebind(`SELECT value FROM sequences WHERE name = ?`), name).Scan(&value); err != nil {
+		return 0, errors.Wrapf(err, "Could not read sequence '%s'", name)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "Could not commit transaction")
+	}
+
+	return value, nil
+}
+
+// GetURLIndex returns the id which is indexed for the url hash, or shared.ErrNoEntryFound.
+func (storage *Storage) GetURLIndex(hash string) (string, error) {
+	var id string
+
+	err := storage.db.QueryRow(storage.dialect.rebind(`SELECT entry_id FROM url_index WHERE url_hash = ?`), hash).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", shared.ErrNoEntryFound
+	}
+
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not look up url hash '%s'", hash)
+	}
+
+	return id, nil
+}
+
+// SetURLIndex indexes the id for the url hash. The expiration is not needed, the
+// index is removed together with the indexed entry.
+func (storage *Storage) SetURLIndex(hash, id string, expiration time.Duration) error {
+	_, err := storage.db.Exec(storage.dialect.rebind(
+		`INSERT INTO url_index (url_hash, entry_id) VALUES (?, ?) ON CONFLICT (url_hash) DO UPDATE SET entry_id = excluded.entry_id`,
+	), hash, id)
+
+	return errors.Wrapf(err, "Could not index url hash '%s'", hash)
+}
+
+// IncreaseCounter increments the named counter and returns its new value, the counter
+// expires after the ttl unless it is increased again.
+func (storage *Storage) IncreaseCounter(name string, ttl time.Duration) (int64, error) {
+	now := time.Now().UTC()
+
+	var expiration interface{}
+	if ttl > 0 {
+		expiration = now.Add(ttl)
+	}
+
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not begin transaction")
+	}
+	defer tx.Rollback()
+
+	// an expired counter which has not been swept yet starts again
+	_, err = tx.Exec(storage.dialect.rebind(`DELETE FROM counters WHERE name = ? AND expiration < ?`), name, now)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not delete expired counter '%s'", name)
+	}
+
+	_, err = tx.Exec(storage.dialect.rebind(`INSERT INTO counters (name, value) VALUES (?, 0) ON CONFLICT (name) DO NOTHING`), name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not create counter '%s'", name)
+	}
+
+	_, err = tx.Exec(storage.dialect.rebind(`UPDATE counters SET value = value + 1, expiration = ? WHERE name = ?`), expiration, name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Could not increment counter '%s'", name)
+	}
+
+	var value int64
+	if err := tx.QueryRow(storage.dialect.rebind(`SELECT value FROM counters WHERE name = ?`), name).Scan(&value); err != nil {
+		return 0, errors.Wrapf(err, "Could not read counter '%s'", name)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "Could not commit transaction")
+	}
+
+	return value, nil
+}
+
+// GetCounter returns the value of the named counter and the time until it expires, a missing counter is zero.
+func (storage *Storage) GetCounter(name string) (int64, time.Duration, error) {
+	var (
+		value      int64
+		expiration timestamp
+	)
+
+	err := storage.db.QueryRow(storage.dialect.rebind(
+		`SELECT value, expiration FROM counters WHERE name = ? AND (expiration IS NULL OR expiration >= ?)`,
+	), name, time.Now().UTC()).Scan(&value, &expiration)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "Could not read counter '%s'", name)
+	}
+
+	if !expiration.Valid {
+		return value, 0, nil
+	}
+
+	return value, time.Until(expiration.Time), nil
+}
+
+// DeleteCounter deletes the named counter.
+func (storage *Storage) DeleteCounter(name string) error {
+	_, err := storage.db.Exec(storage.dialect.rebind(`DELETE FROM counters WHERE name = ?`), name)
+	return errors.Wrapf(err, "Could not delete counter '%s'", name)
+}
+
+// CreateAPIKey stores the api key, it returns shared.ErrEntryAlreadyExist if the id is taken.
+func (storage *Storage) CreateAPIKey(key shared.APIKey) error {
+	result, err := storage.db.Exec(storage.dialect.rebind(
+		`INSERT INTO api_keys (id, hash, owner, scopes, created_on) VALUES (?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`,
+	), key.ID, key.Hash, key.Owner, strings.Join(key.Scopes, ","), key.CreatedOn.UTC())
+	if err != nil {
+		errmsg := fmt.Sprintf("Could not insert api key '%s': %v", key.ID, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	// the insert is skipped if the id is taken
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.Wrapf(shared.ErrEntryAlreadyExist, "Could not create api key '%s'", key.ID)
+	}
+
+	return nil
+}
+
+// scanAPIKey scans a row of the api_keys table into an api key
+func scanAPIKey(scanner interface{ Scan(...interface{}) error }) (*shared.APIKey, error) {
+	var (
+		key       shared.APIKey
+		scopes    string
+		createdOn timestamp
+	)
+
+	if err := scanner.Scan(&key.ID, &key.Hash, &key.Owner, &scopes, &createdOn); err != nil {
+		return nil, err
+	}
+
+	key.Scopes = strings.Split(scopes, ",")
+	key.CreatedOn = &shared.Datetime{Time: createdOn.Local()}
+
+	return &key, nil
+}
+
+// GetAPIKey returns the api key with the id, or shared.ErrNoEntryFound.
+func (storage *Storage) GetAPIKey(id string) (*shared.APIKey, error) {
+	key, err := scanAPIKey(storage.db.QueryRow(storage.dialect.rebind(
+		`SELECT id, hash, owner, scopes, created_on FROM api_keys WHERE id = ?`,
+	), id))
+	if err == sql.ErrNoRows {
+		return nil, shared.ErrNoEntryFound
+	}
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "Could not look up api key '%s'", id)
+	}
+
+	return key, nil
+}
+
+// GetAPIKeys returns every api key ordered by their id.
+func (storage *Storage) GetAPIKeys() ([]shared.APIKey, error) {
+	rows, err := storage.db.Query(`SELECT id, hash, owner, scopes, created_on FROM api_keys ORDER BY id`)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not query api keys")
+	}
+	defer rows.Close()
+
+	var keys []shared.APIKey
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not scan api key")
+		}
+
+		keys = append(keys, *key)
+	}
+
+	return keys, errors.Wrap(rows.Err(), "Could not iterate over the api keys")
+}
+
+// DeleteAPIKey deletes the api key, it returns shared.ErrNoEntryFound if it does not exist.
+func (storage *Storage) DeleteAPIKey(id string) error {
+	result, err := storage.db.Exec(storage.dialect.rebind(`DELETE FROM api_keys WHERE id = ?`), id)
+	if err != nil {
+		return errors.Wrapf(err, "Could not delete api key '%s'", id)
+	}
+
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errors.Wrapf(shared.ErrNoEntryFound, "Could not delete api key '%s'", id)
+	}
+
+	return nil
+}
+
+// Close stops the sweeping and closes the database.
+func (storage *Storage) Close() error {
+	close(storage.stop)
+	<-storage.done
+
+	if err := storage.db.Close(); err != nil {
+		errmsg := fmt.Sprintf("Could not close the %s database: %s", storage.dialect.name, err)
+
+		logger.Error(errmsg)
+		return errors.Wrap(err, errmsg)
+	}
+
+	return nil
+}
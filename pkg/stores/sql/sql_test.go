@@ -0,0 +1,41 @@
+package sql
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+	"github.com/srelab/url-shortener/pkg/stores/storagetest"
+)
+
+func TestMain(m *testing.M) {
+	storagetest.Main(m)
+}
+
+// tempDSN returns the dsn of a new sqlite database in the directory
+func tempDSN(dir string, n int) string {
+	return "file:" + filepath.Join(dir, fmt.Sprintf("main-%d.db", n))
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sql")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var databases int
+	storagetest.Run(t, func(t *testing.T) shared.Storage {
+		databases++
+
+		storage, err := New("sqlite3", tempDSN(dir, databases), "1m")
+		if err != nil {
+			t.Fatalf("could not open storage: %v", err)
+		}
+
+		return storage
+	})
+}
@@ -0,0 +1,425 @@
+// Package storagetest provides the conformance tests of the shared.Storage implementations
+package storagetest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// Main initializes the logger, which is used by the storages, and runs the tests
+func Main(m *testing.M) {
+	dir, err := ioutil.TempDir("", "url-shortener")
+	if err != nil {
+		panic(err)
+	}
+
+	config := g.GetConfig()
+	config.Log.Dir = dir
+	g.SetConfig(config)
+	logger.InitLogger()
+
+	code := m.Run()
+
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// Opener returns an empty storage, it is called once for every test
+type Opener func(t *testing.T) shared.Storage
+
+// Run runs the conformance tests against the storages returned by open
+func Run(t *testing.T, open Opener) {
+	for _, test := range []struct {
+		name string
+		run  func(*testing.T, shared.Storage)
+	}{
+		{"Entries", testEntries},
+		{"UpdateEntry", testUpdateEntry},
+		{"DeleteEntry", testDeleteEntry},
+		{"GetEntries", testGetEntries},
+		{"Visitors", testVisitors},
+		{"Sequences", testSequences},
+		{"URLIndex", testURLIndex},
+		{"Counters", testCounters},
+		{"APIKeys", testAPIKeys},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			storage := open(t)
+			defer storage.Close()
+
+			test.run(t, storage)
+		})
+	}
+}
+
+// datetime returns the point in time relative to now, in the precision of the storages
+func datetime(d time.Duration) *shared.Datetime {
+	return &shared.Datetime{Time: time.Now().Add(d).Truncate(time.Second)}
+}
+
+// sameTime reports whether both points in time are unset or equal
+func sameTime(a, b *shared.Datetime) bool {
+	if a == nil || a.IsZero() || b == nil || b.IsZero() {
+		return (a == nil || a.IsZero()) && (b == nil || b.IsZero())
+	}
+
+	return a.Equal(b.Time)
+}
+
+// mustCreate creates the entry or fails the test
+func mustCreate(t *testing.T, storage shared.Storage, id string, entry shared.Entry) {
+	t.Helper()
+
+	if err := storage.CreateEntry(entry, id); err != nil {
+		t.Fatalf("could not create entry %s: %v", id, err)
+	}
+}
+
+// mustGet returns the entry or fails the test
+func mustGet(t *testing.T, storage shared.Storage, id string) *shared.Entry {
+	t.Helper()
+
+	entry, err := storage.GetEntryByID(id)
+	if err != nil {
+		t.Fatalf("could not get entry %s: %v", id, err)
+	}
+
+	return entry
+}
+
+func testEntries(t *testing.T, storage shared.Storage) {
+	want := shared.Entry{
+		RemoteAddr:  "10.0.0.1",
+		Password:    []byte("hash"),
+		Owner:       "alice",
+		Team:        "platform",
+		RetainUntil: datetime(48 * time.Hour),
+		Public: shared.EntryPublicData{
+			URL:          "https://example.org/entry",
+			CreatedOn:    datetime(0),
+			Expiration:   datetime(24 * time.Hour),
+			ValidFrom:    datetime(time.Hour),
+			RedirectType: 301,
+			Interstitial: true,
+			MaxVisits:    3,
+		},
+	}
+	mustCreate(t, storage, "entry", want)
+
+	got := mustGet(t, storage, "entry")
+	if got.Public.URL != want.Public.URL || string(got.Password) != string(want.Password) || got.RemoteAddr != want.RemoteAddr ||
+		got.Owner != want.Owner || got.Team != want.Team || got.Public.RedirectType != want.Public.RedirectType ||
+		got.Public.Interstitial != want.Public.Interstitial || got.Public.MaxVisits != want.Public.MaxVisits {
+		t.Errorf("expected entry %+v, got %+v", want, got)
+	}
+
+	for name, times := range map[string][2]*shared.Datetime{
+		"creation":   {want.Public.CreatedOn, got.Public.CreatedOn},
+		"expiration": {want.Public.Expiration, got.Public.Expiration},
+		"valid from": {want.Public.ValidFrom, got.Public.ValidFrom},
+	} {
+		if !sameTime(times[0], times[1]) {
+			t.Errorf("expected the %s time %v, got %v", name, times[0], times[1])
+		}
+	}
+
+	if got.Public.VisitCount != 0 {
+		t.Errorf("expected no visits, got %d", got.Public.VisitCount)
+	}
+
+	err := storage.CreateEntry(shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org/other", CreatedOn: datetime(0)}}, "entry")
+	if errors.Cause(err) != shared.ErrEntryAlreadyExist {
+		t.Errorf("expected %v for a taken id, got %v", shared.ErrEntryAlreadyExist, err)
+	}
+
+	if _, err := storage.GetEntryByID("missing"); errors.Cause(err) != shared.ErrNoEntryFound {
+		t.Errorf("expected %v for a missing entry, got %v", shared.ErrNoEntryFound, err)
+	}
+
+	// an expired entry is kept until its retention has passed
+	retained := shared.Entry{RetainUntil: datetime(time.Hour), Public: shared.EntryPublicData{
+		URL: "https://example.org/expired", CreatedOn: datetime(-2 * time.Hour), Expiration: datetime(-time.Hour),
+	}}
+	mustCreate(t, storage, "expired", retained)
+
+	if got := mustGet(t, storage, "expired"); !got.IsExpired() {
+		t.Errorf("expected the retained entry to be expired, got %+v", got.Public)
+	}
+}
+
+func testUpdateEntry(t *testing.T, storage shared.Storage) {
+	entry := shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org/typo", CreatedOn: datetime(0)}}
+	mustCreate(t, storage, "entry", entry)
+
+	visit := shared.Visit{EntryID: "entry", Visitor: shared.Visitor{IP: "10.0.0.1", Timestamp: datetime(0)}}
+	if err := storage.RegisterVisitors([]shared.Visit{visit}); err != nil {
+		t.Fatalf("could not register visit: %v", err)
+	}
+
+	entry.Public.URL = "https://example.org/fixed"
+	entry.Public.Expiration = datetime(time.Hour)
+	if err := storage.UpdateEntry("entry", entry); err != nil {
+		t.Fatalf("could not update entry: %v", err)
+	}
+
+	got := mustGet(t, storage, "entry")
+	if got.Public.URL != entry.Public.URL || !sameTime(got.Public.Expiration, entry.Public.Expiration) {
+		t.Errorf("expected the updated entry %+v, got %+v", entry.Public, got.Public)
+	}
+
+	if got.Public.VisitCount != 1 {
+		t.Errorf("expected the visits to be kept, got visit count %d", got.Public.VisitCount)
+	}
+
+	if err := storage.UpdateEntry("missing", entry); errors.Cause(err) != shared.ErrNoEntryFound {
+		t.Errorf("expected %v for a missing entry, got %v", shared.ErrNoEntryFound, err)
+	}
+}
+
+func testDeleteEntry(t *testing.T, storage shared.Storage) {
+	mustCreate(t, storage, "entry", shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org", CreatedOn: datetime(0)}})
+
+	visit := shared.Visit{EntryID: "entry", Visitor: shared.Visitor{IP: "10.0.0.1", Timestamp: datetime(0)}}
+	if err := storage.RegisterVisitors([]shared.Visit{visit}); err != nil {
+		t.Fatalf("could not register visit: %v", err)
+	}
+
+	if err := storage.DeleteEntry("entry"); err != nil {
+		t.Fatalf("could not delete entry: %v", err)
+	}
+
+	if _, err := storage.GetEntryByID("entry"); errors.Cause(err) != shared.ErrNoEntryFound {
+		t.Errorf("expected %v for a deleted entry, got %v", shared.ErrNoEntryFound, err)
+	}
+
+	// a new entry with the id starts without the visitors of the deleted one
+	mustCreate(t, storage, "entry", shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org", CreatedOn: datetime(0)}})
+	if visitors, err := storage.GetVisitors("entry", shared.VisitorQuery{}); err != nil || len(visitors) != 0 {
+		t.Errorf("expected no visitors, got %v, %v", visitors, err)
+	}
+}
+
+func testGetEntries(t *testing.T, storage shared.Storage) {
+	for i := 0; i < 5; i++ {
+		owner := "alice"
+		if i%2 == 1 {
+			owner = "bob"
+		}
+
+		mustCreate(t, storage, fmt.Sprintf("entry%d", i), shared.Entry{Owner: owner, Public: shared.EntryPublicData{
+			URL: fmt.Sprintf("https://example.org/%d", i), CreatedOn: datetime(0),
+		}})
+	}
+
+	for _, test := range []struct {
+		query shared.EntryQuery
+		want  int
+	}{
+		{shared.EntryQuery{Limit: 2}, 5},
+		{shared.EntryQuery{Limit: 2, Owner: "alice"}, 3},
+		{shared.EntryQuery{Limit: 10, Owner: "bob"}, 2},
+		{shared.EntryQuery{Limit: 2, Owner: "carol"}, 0},
+		{shared.EntryQuery{}, 5},
+		{shared.EntryQuery{Limit: -1, Owner: "alice"}, 3},
+	} {
+		seen := map[string]bool{}
+
+		query := test.query
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatalf("expected the listing of %+v to end", test.query)
+			}
+
+			entries, cursor, err := storage.GetEntries(query)
+			if err != nil {
+				t.Fatalf("could not get entries of %+v: %v", query, err)
+			}
+
+			if query.Limit > 0 && len(entries) > query.Limit {
+				t.Errorf("expected at most %d entries per page, got %d", query.Limit, len(entries))
+			}
+
+			// without a limit every entry is on the first page
+			if query.Limit <= 0 && cursor != "" {
+				t.Errorf("expected a single page for %+v, got the cursor %q", test.query, cursor)
+			}
+
+			for id, entry := range entries {
+				if seen[id] || (query.Owner != "" && entry.Owner != query.Owner) {
+					t.Errorf("unexpected entry %s of %s in the listing of %+v", id, entry.Owner, test.query)
+				}
+
+				seen[id] = true
+			}
+
+			if cursor == "" {
+				break
+			}
+
+			query.Cursor = cursor
+		}
+
+		if len(seen) != test.want {
+			t.Errorf("expected %d entries for %+v, got %v", test.want, test.query, seen)
+		}
+	}
+}
+
+func testVisitors(t *testing.T, storage shared.Storage) {
+	mustCreate(t, storage, "entry", shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org", CreatedOn: datetime(0)}})
+
+	start := time.Date(2019, 1, 1, 12, 0, 0, 0, time.Local)
+	visits := []shared.Visit{{EntryID: "missing", Visitor: shared.Visitor{IP: "10.0.0.9", Timestamp: &shared.Datetime{Time: start}}}}
+	for i := 0; i < 5; i++ {
+		visits = append(visits, shared.Visit{EntryID: "entry", Visitor: shared.Visitor{
+			IP:        fmt.Sprintf("10.0.0.%d", i),
+			Referer:   "https://example.com",
+			UserAgent: "test",
+			UTMSource: "newsletter",
+			Timestamp: &shared.Datetime{Time: start.Add(time.Duration(i) * time.Hour)},
+		}})
+	}
+
+	if err := storage.RegisterVisitors(visits); err != nil {
+		t.Fatalf("could not register visits: %v", err)
+	}
+
+	entry := mustGet(t, storage, "entry")
+	if entry.Public.VisitCount != 5 || !sameTime(entry.Public.LastVisit, &shared.Datetime{Time: start.Add(4 * time.Hour)}) {
+		t.Errorf("expected 5 visits with the last at %v, got %d at %v", start.Add(4*time.Hour), entry.Public.VisitCount, entry.Public.LastVisit)
+	}
+
+	for _, test := range []struct {
+		query shared.VisitorQuery
+		want  []string
+	}{
+		{shared.VisitorQuery{}, []string{"10.0.0.4", "10.0.0.3", "10.0.0.2", "10.0.0.1", "10.0.0.0"}},
+		{shared.VisitorQuery{Offset: 1, Limit: 2}, []string{"10.0.0.3", "10.0.0.2"}},
+		{shared.VisitorQuery{From: start.Add(time.Hour), To: start.Add(3 * time.Hour)}, []string{"10.0.0.3", "10.0.0.2", "10.0.0.1"}},
+		{shared.VisitorQuery{Offset: 5}, nil},
+	} {
+		visitors, err := storage.GetVisitors("entry", test.query)
+		if err != nil {
+			t.Fatalf("could not get visitors of %+v: %v", test.query, err)
+		}
+
+		var got []string
+		for _, visitor := range visitors {
+			got = append(got, visitor.IP)
+		}
+
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("expected the visitors %v for %+v, got %v", test.want, test.query, got)
+		}
+	}
+
+	visitors, _ := storage.GetVisitors("entry", shared.VisitorQuery{Limit: 1})
+	if len(visitors) != 1 || visitors[0].Referer != "https://example.com" || visitors[0].UserAgent != "test" || visitors[0].UTMSource != "newsletter" {
+		t.Errorf("expected the details of the visitor to be kept, got %+v", visitors)
+	}
+
+	if visitors, err := storage.GetVisitors("missing", shared.VisitorQuery{}); err != nil || len(visitors) != 0 {
+		t.Errorf("expected the visits of a missing entry to be skipped, got %v, %v", visitors, err)
+	}
+}
+
+func testSequences(t *testing.T, storage shared.Storage) {
+	for _, test := range []struct {
+		name string
+		want uint64
+	}{{"ids", 1}, {"ids", 2}, {"other", 1}, {"ids", 3}} {
+		if got, err := storage.NextSequence(test.name); err != nil || got != test.want {
+			t.Errorf("expected %d of the sequence %s, got %d, %v", test.want, test.name, got, err)
+		}
+	}
+}
+
+func testURLIndex(t *testing.T, storage shared.Storage) {
+	if _, err := storage.GetURLIndex("hash"); errors.Cause(err) != shared.ErrNoEntryFound {
+		t.Errorf("expected %v for a missing hash, got %v", shared.ErrNoEntryFound, err)
+	}
+
+	for _, id := range []string{"first", "second"} {
+		if err := storage.SetURLIndex("hash", id, time.Hour); err != nil {
+			t.Fatalf("could not index %s: %v", id, err)
+		}
+
+		if got, err := storage.GetURLIndex("hash"); err != nil || got != id {
+			t.Errorf("expected the indexed id %s, got %q, %v", id, got, err)
+		}
+	}
+}
+
+func testCounters(t *testing.T, storage shared.Storage) {
+	if value, ttl, err := storage.GetCounter("attempts"); err != nil || value != 0 || ttl != 0 {
+		t.Errorf("expected a missing counter to be zero, got %d, %v, %v", value, ttl, err)
+	}
+
+	for want := int64(1); want <= 2; want++ {
+		if got, err := storage.IncreaseCounter("attempts", time.Hour); err != nil || got != want {
+			t.Errorf("expected the counter %d, got %d, %v", want, got, err)
+		}
+	}
+
+	value, ttl, err := storage.GetCounter("attempts")
+	if err != nil || value != 2 || ttl <= 0 || ttl > time.Hour {
+		t.Errorf("expected the counter 2 with a ttl up to 1h, got %d, %v, %v", value, ttl, err)
+	}
+
+	if err := storage.DeleteCounter("attempts"); err != nil {
+		t.Fatalf("could not delete counter: %v", err)
+	}
+
+	if value, _, _ := storage.GetCounter("attempts"); value != 0 {
+		t.Errorf("expected the deleted counter to be zero, got %d", value)
+	}
+}
+
+func testAPIKeys(t *testing.T, storage shared.Storage) {
+	keys := []shared.APIKey{
+		{ID: "b", Hash: []byte("hash-b"), Owner: "bob", Scopes: []string{shared.ScopeRead}, CreatedOn: datetime(0)},
+		{ID: "a", Hash: []byte("hash-a"), Owner: "alice", Scopes: []string{shared.ScopeCreate, shared.ScopeRead}, CreatedOn: datetime(0)},
+	}
+
+	for _, key := range keys {
+		if err := storage.CreateAPIKey(key); err != nil {
+			t.Fatalf("could not create api key %s: %v", key.ID, err)
+		}
+	}
+
+	if err := storage.CreateAPIKey(keys[0]); errors.Cause(err) != shared.ErrEntryAlreadyExist {
+		t.Errorf("expected %v for a taken id, got %v", shared.ErrEntryAlreadyExist, err)
+	}
+
+	key, err := storage.GetAPIKey("a")
+	if err != nil || string(key.Hash) != "hash-a" || key.Owner != "alice" || fmt.Sprint(key.Scopes) != "[create read]" ||
+		!sameTime(key.CreatedOn, keys[1].CreatedOn) {
+		t.Errorf("expected api key %+v, got %+v, %v", keys[1], key, err)
+	}
+
+	listed, err := storage.GetAPIKeys()
+	if err != nil || len(listed) != 2 || listed[0].ID != "a" || listed[1].ID != "b" {
+		t.Errorf("expected the api keys ordered by their id, got %+v, %v", listed, err)
+	}
+
+	if err := storage.DeleteAPIKey("a"); err != nil {
+		t.Fatalf("could not delete api key: %v", err)
+	}
+
+	if _, err := storage.GetAPIKey("a"); errors.Cause(err) != shared.ErrNoEntryFound {
+		t.Errorf("expected %v for a deleted api key, got %v", shared.ErrNoEntryFound, err)
+	}
+
+	if err := storage.DeleteAPIKey("a"); errors.Cause(err) != shared.ErrNoEntryFound {
+		t.Errorf("expected %v for a missing api key, got %v", shared.ErrNoEntryFound, err)
+	}
+}
@@ -3,12 +3,10 @@ package stores
 
 import (
 	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha512"
-	"math/big"
+	"path/filepath"
 	"strings"
 	"time"
-	"unicode"
 
 	"github.com/go-playground/validator"
 
@@ -18,23 +16,58 @@ import (
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
 	"github.com/srelab/url-shortener/pkg/g"
+	"github.com/srelab/url-shortener/pkg/stores/bolt"
+	"github.com/srelab/url-shortener/pkg/stores/memory"
 	"github.com/srelab/url-shortener/pkg/stores/redis"
 	"github.com/srelab/url-shortener/pkg/stores/shared"
+	"github.com/srelab/url-shortener/pkg/stores/sql"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // Store holds internal funcs and vars about the store
 type Store struct {
-	storage  shared.Storage
-	idLength int
+	storage   shared.Storage
+	ids       IDGenerator
+	customIDs customIDRules
+	reserved  *reservedIDs
+	attempts  attemptPolicy
+	visits    *visitQueue
+	retention time.Duration // expired entries are kept for this duration
+	limiter   shared.RateLimiter
+	policy    *urlPolicy
+	chains    *chainPolicy
 }
 
 // ErrNoValidURL is returned when the URL is not valid
 var ErrNoValidURL = errors.New("the given URL is no valid URL")
 
+// maxIDTries is the number of generated ids which are tried for a new entry
+const maxIDTries = 10
+
 // ErrGeneratingIDFailed is returned when the 10 tries to generate an id failed
 var ErrGeneratingIDFailed = errors.New("could not generate unique id, all ten tries failed")
 
+// ErrHmacVerificationFailed is returned when the given hmac does not belong to the id
+var ErrHmacVerificationFailed = errors.New("hmac verification failed")
+
+// ErrExpirationInPast is returned when an entry would be created or updated with an expiration in the past
+var ErrExpirationInPast = errors.New("the expiration is in the past")
+
+// ErrInvalidValidity is returned when an entry would expire before it is valid
+var ErrInvalidValidity = errors.New("the valid from time is not before the expiration")
+
+// EntryUpdate holds the changes of an entry, nil fields are kept as they are
+type EntryUpdate struct {
+	URL        *string
+	Expiration *shared.Datetime // the zero time removes the expiration
+	Password   *string          // the empty string removes the password
+	// RedirectType 0 resets the status code of the redirect to the configured default
+	RedirectType *int
+	Interstitial *bool
+	MaxVisits    *int             // 0 removes the limit
+	ValidFrom    *shared.Datetime // the zero time makes the entry valid immediately
+}
+
 // New initializes the store with the db
 func New() (*Store, error) {
 	var err error
@@ -43,10 +76,35 @@ func New() (*Store, error) {
 	switch backend := g.GetConfig().Backend; backend {
 	case "redis":
 		conf := g.GetConfig().Redis
-		storage, err = redis.New(conf.Host, conf.Password, conf.DB, conf.MaxRetries, conf.ReadTimeout, conf.WriteTimeout)
+		storage, err = redis.New(conf.Host, conf.Password, conf.DB, conf.MaxRetries, conf.ReadTimeout, conf.WriteTimeout, conf.KeyPrefix)
+
+	case "bolt":
+		if err = util.CheckForPrivateKey(); err != nil {
+			return nil, errors.Wrap(err, "could not check for the private key")
+		}
+
+		conf := g.GetConfig().Bolt
+		storage, err = bolt.New(filepath.Join(g.GetConfig().DataDir, conf.File), conf.SweepInterval)
+
+	case "sql":
+		if err = util.CheckForPrivateKey(); err != nil {
+			return nil, errors.Wrap(err, "could not check for the private key")
+		}
+
+		conf := g.GetConfig().SQL
+		if conf.DSN == "" && conf.Dialect == "sqlite3" {
+			conf.DSN = filepath.Join(g.GetConfig().DataDir, "main.sqlite")
+		}
+
+		storage, err = sql.New(conf.Dialect, conf.DSN, conf.SweepInterval)
+
+	case "memory":
+		if err = util.CheckForPrivateKey(); err != nil {
+			return nil, errors.Wrap(err, "could not check for the private key")
+		}
+
+		storage, err = memory.New(g.GetConfig().Memory.SweepInterval)
 
-	//	TODO: badger key value db support
-	//case "more storage implement":
 	default:
 		return nil, errors.New(backend + " is not a recognized backend")
 	}
@@ -55,9 +113,47 @@ func New() (*Store, error) {
 		return nil, errors.Wrap(err, "could not initialize the data backend")
 	}
 
+	ids, err := newIDGenerator(storage)
+	if err != nil {
+		storage.Close()
+		return nil, errors.Wrap(err, "could not initialize the id generator")
+	}
+
+	conf := g.GetConfig().Password
+	attempts, err := newAttemptPolicy(conf.AttemptWindow, conf.Lockout, conf.MaxLockout)
+	if err != nil {
+		storage.Close()
+		return nil, errors.Wrap(err, "could not initialize the attempt policy")
+	}
+
+	retention, err := time.ParseDuration(g.GetConfig().ExpiredRetention)
+	if err != nil {
+		storage.Close()
+		return nil, errors.Wrap(err, "could not parse the retention of expired entries")
+	}
+
+	policy, err := newURLPolicy()
+	if err != nil {
+		storage.Close()
+		return nil, errors.Wrap(err, "could not initialize the URL policy")
+	}
+
+	limiter, ok := storage.(shared.RateLimiter)
+	if !ok {
+		limiter = newBucketLimiter()
+	}
+
 	return &Store{
-		storage:  storage,
-		idLength: g.GetConfig().ShortedIDLength,
+		storage:   storage,
+		ids:       ids,
+		customIDs: customIDRules{maxLength: g.GetConfig().CustomIDMaxLength},
+		reserved:  newReservedIDs(g.GetConfig().ReservedIDs...),
+		attempts:  attempts,
+		visits:    newVisitQueue(storage, g.GetConfig().Visits.QueueSize, g.GetConfig().Visits.BatchSize),
+		retention: retention,
+		limiter:   limiter,
+		policy:    policy,
+		chains:    newChainPolicy(),
 	}, nil
 }
 
@@ -66,83 +162,283 @@ func (store *Store) GetEntryByID(id string) (*shared.Entry, error) {
 	if id == "" {
 		return nil, shared.ErrNoEntryFound
 	}
-	return store.storage.GetEntryByID(id)
-}
 
-// GetEntryAndIncrease Increases the visitor count, checks
-// if the URL is expired and returns the origin URL
-func (store *Store) GetEntryAndIncrease(id string) (*shared.Entry, error) {
-	entry, err := store.GetEntryByID(id)
+	entry, err := store.storage.GetEntryByID(id)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not fetch entry "+id)
+		return nil, err
 	}
 
-	if err := store.storage.IncreaseVisitCounter(id); err != nil {
-		return nil, errors.Wrap(err, "could not increase visitor counter")
-	}
+	entry.Public.Expired = entry.IsExpired()
+	store.setRemainingVisits(id, entry)
 
-	entry.Public.VisitCount++
 	return entry, nil
 }
 
-// CreateEntry creates a new record and returns his short id
-func (store *Store) CreateEntry(entry shared.Entry, givenID, password string) (string, []byte, error) {
-	entry.Public.URL = strings.Replace(entry.Public.URL, " ", "%20", -1)
-	if err := validator.New().Var(entry.Public.URL, "required,url"); err != nil {
-		return "", nil, ErrNoValidURL
+// CreateEntry creates a new record and returns his short id. With dedupe the existing entry of
+// the URL is returned instead, if the password and the expiration match and no id is given; the
+// deletion hmac is only returned for new entries. The host is the one the request was sent to, it
+// serves the short URLs unless the hosts of the chains are configured.
+func (store *Store) CreateEntry(entry shared.Entry, givenID, password string, dedupe bool, host string) (string, []byte, error) {
+	var err error
+	var danglingID string
+	if entry.Public.URL, danglingID, err = store.checkURL(entry.Public.URL, givenID, host); err != nil {
+		return "", nil, err
 	}
 
-	if password != "" {
-		var err error
-		entry.Password, err = bcrypt.GenerateFromPassword([]byte(password), 10)
-		if err != nil {
-			return "", nil, errors.Wrap(err, "could not generate bcrypt from password")
+	if entry.IsExpired() {
+		return "", nil, ErrExpirationInPast
+	}
+
+	if err := validateValidity(&entry); err != nil {
+		return "", nil, err
+	}
+
+	// every link with a visit limit is handed out on its own
+	dedupe = dedupe && givenID == "" && entry.Public.MaxVisits == 0
+	if dedupe {
+		if id, ok := store.findDuplicate(entry, password); ok {
+			return id, nil, nil
 		}
 	}
 
-	// try it 10 times to make a short URL
-	for i := 1; i <= 10; i++ {
-		id, passwordHash, err := store.createEntry(entry, givenID)
-		if err != nil && givenID != "" {
+	if entry.Password, err = hashPassword(password); err != nil {
+		return "", nil, err
+	}
+
+	if givenID != "" {
+		if store.reserved.contains(givenID) {
+			return "", nil, errors.Wrapf(ErrReservedID, "could not use id '%s'", givenID)
+		}
+
+		if err := store.customIDs.validate(givenID); err != nil {
+			return "", nil, err
+		}
+
+		return store.createEntry(entry, givenID)
+	}
+
+	// try it 10 times to make a short URL, the generator may react on the collisions
+	for i := 1; i <= maxIDTries; i++ {
+		id, err := store.ids.Generate()
+		if err != nil {
+			return "", nil, errors.Wrap(err, "could not generate id")
+		}
+
+		// the URL points to the short URL of this id, which does not exist yet
+		if id == danglingID {
+			continue
+		}
+
+		// the reserved ids collide with the routes and pages, like taken ids
+		if store.reserved.contains(id) {
+			logger.Debugf("Skip the reserved id '%s'", id)
+			store.ids.Collided(id, i)
+			continue
+		}
+
+		_, passwordHash, err := store.createEntry(entry, id)
+		if err != nil && errors.Cause(err) != shared.ErrEntryAlreadyExist {
 			return "", nil, err
 		} else if err != nil {
 			logger.Debugf("Could not create entry: %v", err)
+			store.ids.Collided(id, i)
 			continue
 		}
 
+		if dedupe {
+			store.indexURL(entry, id)
+		}
+
 		return id, passwordHash, nil
 	}
 
 	return "", nil, ErrGeneratingIDFailed
 }
 
+// ReserveIDs adds ids to the registry of reserved ids, which can not be used as custom ids
+func (store *Store) ReserveIDs(ids ...string) {
+	store.reserved.add(ids...)
+}
+
+// UpdateEntry changes the URL, the expiration or the password of an entry, authorized by the
+// hmac of its deletion URL. The visits of the entry are kept. The host is the one the request was
+// sent to, as for CreateEntry.
+func (store *Store) UpdateEntry(id string, givenHmac []byte, update EntryUpdate, host string) (*shared.Entry, error) {
+	if err := verifyHmac(id, givenHmac); err != nil {
+		return nil, err
+	}
+
+	entry, err := store.GetEntryByID(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not fetch entry "+id)
+	}
+
+	if update.URL != nil {
+		if entry.Public.URL, _, err = store.checkURL(*update.URL, id, host); err != nil {
+			return nil, err
+		}
+	}
+
+	if update.Expiration != nil {
+		entry.Public.Expiration = update.Expiration
+		if update.Expiration.IsZero() {
+			entry.Public.Expiration = nil
+		}
+
+		if entry.IsExpired() {
+			return nil, ErrExpirationInPast
+		}
+	}
+
+	if update.Password != nil {
+		if entry.Password, err = hashPassword(*update.Password); err != nil {
+			return nil, err
+		}
+	}
+
+	if update.RedirectType != nil {
+		entry.Public.RedirectType = *update.RedirectType
+	}
+
+	if update.Interstitial != nil {
+		entry.Public.Interstitial = *update.Interstitial
+	}
+
+	if update.MaxVisits != nil {
+		entry.Public.MaxVisits = *update.MaxVisits
+	}
+
+	if update.ValidFrom != nil {
+		entry.Public.ValidFrom = update.ValidFrom
+		if update.ValidFrom.IsZero() {
+			entry.Public.ValidFrom = nil
+		}
+	}
+
+	if err := validateValidity(entry); err != nil {
+		return nil, err
+	}
+
+	// the visit statistics are derived from the visits by the storage
+	stored := *entry
+	stored.Public.VisitCount, stored.Public.LastVisit, stored.Public.Expired = 0, nil, false
+	stored.Public.RemainingVisits = nil
+	store.retain(&stored)
+
+	if err := store.storage.UpdateEntry(id, stored); err != nil {
+		return nil, errors.Wrap(err, "could not update entry")
+	}
+
+	store.setRemainingVisits(id, entry)
+
+	return entry, nil
+}
+
 // DeleteEntry deletes an Entry fully from the DB
 func (store *Store) DeleteEntry(id string, givenHmac []byte) error {
+	if err := verifyHmac(id, givenHmac); err != nil {
+		return err
+	}
+
+	if err := store.storage.DeleteEntry(id); err != nil {
+		return errors.Wrap(err, "could not delete entry")
+	}
+
+	// a new entry with the id starts without visits
+	return errors.Wrap(store.storage.DeleteCounter(visitLimitCounter(id)), "could not delete the visit limit")
+}
+
+// verifyHmac returns ErrHmacVerificationFailed if the hmac does not belong to the id
+func verifyHmac(id string, givenHmac []byte) error {
 	mac := hmac.New(sha512.New, util.GetPrivateKey())
 	if _, err := mac.Write([]byte(id)); err != nil {
 		return errors.Wrap(err, "could not write hmac")
 	}
 
 	if !hmac.Equal(mac.Sum(nil), givenHmac) {
-		return errors.New("hmac verification failed")
+		return ErrHmacVerificationFailed
 	}
 
-	return errors.Wrap(store.storage.DeleteEntry(id), "could not delete entry")
+	return nil
 }
 
-// RegisterVisit registers an new incoming request in the store
+// validateValidity returns ErrInvalidValidity if the entry expires before it is valid
+func validateValidity(entry *shared.Entry) error {
+	validFrom, expiration := entry.Public.ValidFrom, entry.Public.Expiration
+	if validFrom == nil || validFrom.IsZero() || expiration == nil || expiration.IsZero() {
+		return nil
+	}
+
+	if !validFrom.Before(expiration.Time) {
+		return ErrInvalidValidity
+	}
+
+	return nil
+}
+
+// normalizeURL escapes the spaces of the URL and returns ErrNoValidURL if it is no valid URL
+func normalizeURL(url string) (string, error) {
+	url = strings.Replace(url, " ", "%20", -1)
+	if err := validator.New().Var(url, "required,url"); err != nil {
+		return "", ErrNoValidURL
+	}
+
+	return url, nil
+}
+
+// checkURL normalizes the URL of the entry with the id, follows the chain of short URLs of this service
+// it starts, see resolveChain, and returns a PolicyError if the URL policy rejects the destination
+func (store *Store) checkURL(url, id, host string) (string, string, error) {
+	url, err := normalizeURL(url)
+	if err != nil {
+		return "", "", err
+	}
+
+	url, danglingID, err := store.resolveChain(url, id, host)
+	if err != nil {
+		return "", "", err
+	}
+
+	// the short URLs of this service are trusted, their destinations were checked
+	if _, ok := store.chains.shortID(url, store.customIDs, host); ok {
+		return url, danglingID, nil
+	}
+
+	if err := store.policy.check(url); err != nil {
+		return "", "", err
+	}
+
+	return url, danglingID, nil
+}
+
+// hashPassword returns the bcrypt hash of the password, or nil for the empty password
+func hashPassword(password string) ([]byte, error) {
+	if password == "" {
+		return nil, nil
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not generate bcrypt from password")
+	}
+
+	return hash, nil
+}
+
+// RegisterVisit queues an new incoming request for the registration in the store. The visit count
+// of the entry is derived from the registered visits, so it includes the visit once it is written.
 func (store *Store) RegisterVisit(id string, visitor shared.Visitor) {
 	requestID := uuid.New()
 	logger.Infof("[%s][%s][%s]New redirect was registered...", requestID, id, visitor.IP)
 
-	if err := store.storage.RegisterVisitor(id, requestID, visitor); err != nil {
-		logger.Warnf("could not register visit: %v", err)
+	if !store.visits.push(shared.Visit{EntryID: id, Visitor: visitor}) {
+		logger.Debugf("[%s][%s]Dropped the visit, the visit queue is full", requestID, id)
 	}
 }
 
-// GetVisitors returns all the visits of a shorted URL
-func (store *Store) GetVisitors(id string) ([]shared.Visitor, error) {
-	visitors, err := store.storage.GetVisitors(id)
+// GetVisitors returns the visits of a shorted URL which are selected by the query
+func (store *Store) GetVisitors(id string, query shared.VisitorQuery) ([]shared.Visitor, error) {
+	visitors, err := store.storage.GetVisitors(id, query)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not get visitors")
 	}
@@ -150,30 +446,30 @@ func (store *Store) GetVisitors(id string) ([]shared.Visitor, error) {
 	return visitors, nil
 }
 
-func (store *Store) GetEntries() (map[string]shared.Entry, error) {
-	entries, err := store.storage.GetEntries()
+// GetEntries returns a page of the entries selected by the query and the cursor of the following page
+func (store *Store) GetEntries(query shared.EntryQuery) (map[string]shared.Entry, string, error) {
+	entries, nextCursor, err := store.storage.GetEntries(query)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not get entries")
+		return nil, "", errors.Wrap(err, "could not get entries")
+	}
+
+	for id, entry := range entries {
+		entry.Public.Expired = entry.IsExpired()
+		store.setRemainingVisits(id, &entry)
+		entries[id] = entry
 	}
 
-	return entries, nil
+	return entries, nextCursor, nil
 }
 
 // Close closes the bolt db database
 func (store *Store) Close() error {
+	store.visits.close()
 	return store.storage.Close()
 }
 
-// createEntry creates a new entry with a randomly generated id. If on is present
-// then the given ID is used
+// createEntry creates a new entry with the given id
 func (store *Store) createEntry(entry shared.Entry, entryID string) (string, []byte, error) {
-	var err error
-	if entryID == "" {
-		if entryID, err = generateRandomString(store.idLength); err != nil {
-			return "", nil, errors.Wrap(err, "could not generate random string")
-		}
-	}
-
 	entry.Public.CreatedOn = &shared.Datetime{Time: time.Now()}
 	mac := hmac.New(sha512.New, util.GetPrivateKey())
 
@@ -181,6 +477,7 @@ func (store *Store) createEntry(entry shared.Entry, entryID string) (string, []b
 		return "", nil, errors.Wrap(err, "could not write hmac")
 	}
 
+	store.retain(&entry)
 	if err := store.storage.CreateEntry(entry, entryID); err != nil {
 		return "", nil, errors.Wrap(err, "could not create entry")
 	}
@@ -188,20 +485,10 @@ func (store *Store) createEntry(entry shared.Entry, entryID string) (string, []b
 	return entryID, mac.Sum(nil), nil
 }
 
-// generateRandomString generates a random string with an predefined length
-func generateRandomString(length int) (string, error) {
-	var result string
-	for len(result) < length {
-		num, err := rand.Int(rand.Reader, big.NewInt(int64(127)))
-		if err != nil {
-			return "", err
-		}
-
-		n := num.Int64()
-		if unicode.IsLetter(rune(n)) {
-			result += string(n)
-		}
+// retain sets the point in time until the entry is kept in the storage after it expired
+func (store *Store) retain(entry *shared.Entry) {
+	entry.RetainUntil = nil
+	if store.retention > 0 && entry.Public.Expiration != nil && !entry.Public.Expiration.IsZero() {
+		entry.RetainUntil = &shared.Datetime{Time: entry.Public.Expiration.Add(store.retention)}
 	}
-
-	return result, nil
 }
@@ -0,0 +1,168 @@
+package stores
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/srelab/url-shortener/pkg/logger"
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+// ErrVisitLimitReached is returned if the entry was visited as often as its visit limit allows
+var ErrVisitLimitReached = errors.New("visit limit reached")
+
+// visitLimitCounter returns the name of the storage counter of the visits of an entry with a visit limit
+func visitLimitCounter(id string) string {
+	return "visits:" + id
+}
+
+// ClaimVisit counts a visit of an entry with a visit limit, it returns ErrVisitLimitReached once the
+// limit is reached. The storage increments the counter atomically, so concurrent visits never exceed
+// the limit. The counter is removed together with the entry.
+func (store *Store) ClaimVisit(id string, entry *shared.Entry) error {
+	if entry.Public.MaxVisits <= 0 {
+		return nil
+	}
+
+	visits, err := store.storage.IncreaseCounter(visitLimitCounter(id), entry.GetRetention())
+	if err != nil {
+		return errors.Wrap(err, "could not count the visit")
+	}
+
+	if visits > int64(entry.Public.MaxVisits) {
+		return errors.Wrapf(ErrVisitLimitReached, "entry '%s' was visited %d times", id, entry.Public.MaxVisits)
+	}
+
+	remaining := entry.Public.MaxVisits - int(visits)
+	entry.Public.RemainingVisits = &remaining
+	return nil
+}
+
+// setRemainingVisits sets the remaining visits of an entry with a visit limit
+func (store *Store) setRemainingVisits(id string, entry *shared.Entry) {
+	entry.Public.RemainingVisits = nil
+	if entry.Public.MaxVisits <= 0 {
+		return
+	}
+
+	visits, _, err := store.storage.GetCounter(visitLimitCounter(id))
+	if err != nil {
+		logger.Warnf("could not get the visits of entry '%s': %v", id, err)
+		return
+	}
+
+	remaining := entry.Public.MaxVisits - int(visits)
+	if remaining < 0 {
+		remaining = 0
+	}
+
+	entry.Public.RemainingVisits = &remaining
+}
+
+// visitMetrics count the visits which were queued, written to the storage, dropped because
+// the queue was full, and which failed to be written. They are published by expvar as "visits".
+var visitMetrics = expvar.NewMap("visits")
+
+// VisitMetrics returns the current values of the visit metrics
+func VisitMetrics() map[string]int64 {
+	metrics := map[string]int64{"queued": 0, "written": 0, "dropped": 0, "failed": 0}
+	visitMetrics.Do(func(kv expvar.KeyValue) {
+		if value, ok := kv.Value.(*expvar.Int); ok {
+			metrics[kv.Key] = value.Value()
+		}
+	})
+
+	return metrics
+}
+
+// visitQueue registers the visits in the background. A single writer takes the visits from a bounded
+// queue, the visits which queued up during a write are written together in the next batch.
+type visitQueue struct {
+	mu        sync.RWMutex
+	closed    bool
+	storage   shared.Storage
+	visits    chan shared.Visit
+	batchSize int
+	done      chan struct{}
+}
+
+// newVisitQueue starts the writer of a queue which holds up to size visits
+func newVisitQueue(storage shared.Storage, size, batchSize int) *visitQueue {
+	queue := &visitQueue{
+		storage:   storage,
+		visits:    make(chan shared.Visit, size),
+		batchSize: batchSize,
+		done:      make(chan struct{}),
+	}
+
+	go queue.run()
+	return queue
+}
+
+// push queues the visit without blocking, it reports false if the visit was dropped
+func (queue *visitQueue) push(visit shared.Visit) bool {
+	queue.mu.RLock()
+	defer queue.mu.RUnlock()
+
+	if !queue.closed {
+		select {
+		case queue.visits <- visit:
+			visitMetrics.Add("queued", 1)
+			return true
+		default:
+		}
+	}
+
+	visitMetrics.Add("dropped", 1)
+	return false
+}
+
+// run writes the queued visits until the queue is closed and drained
+func (queue *visitQueue) run() {
+	defer close(queue.done)
+
+	batch := make([]shared.Visit, 0, queue.batchSize)
+	for visit := range queue.visits {
+		batch = append(batch[:0], visit)
+
+	collect:
+		for len(batch) < queue.batchSize {
+			select {
+			case visit, ok := <-queue.visits:
+				if !ok {
+					break collect
+				}
+
+				batch = append(batch, visit)
+			default:
+				break collect
+			}
+		}
+
+		queue.write(batch)
+	}
+}
+
+// write registers the batch of visits in the storage
+func (queue *visitQueue) write(batch []shared.Visit) {
+	if err := queue.storage.RegisterVisitors(batch); err != nil {
+		logger.Warnf("could not register %d visits: %v", len(batch), err)
+		visitMetrics.Add("failed", int64(len(batch)))
+		return
+	}
+
+	visitMetrics.Add("written", int64(len(batch)))
+}
+
+// close stops accepting visits and waits until the queued visits are written
+func (queue *visitQueue) close() {
+	queue.mu.Lock()
+	if !queue.closed {
+		queue.closed = true
+		close(queue.visits)
+	}
+	queue.mu.Unlock()
+
+	<-queue.done
+}
@@ -0,0 +1,40 @@
+package stores
+
+import (
+	"testing"
+	"time"
+
+	"github.com/srelab/url-shortener/pkg/stores/shared"
+)
+
+func TestVisitQueue(t *testing.T) {
+	storage := newMemoryStorage(t)
+	if err := storage.CreateEntry(shared.Entry{Public: shared.EntryPublicData{URL: "https://example.org"}}, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	before := VisitMetrics()
+	queue := newVisitQueue(storage, 10, 2)
+
+	for _, id := range []string{"a", "a", "missing", "a"} {
+		if !queue.push(shared.Visit{EntryID: id, Visitor: shared.Visitor{Timestamp: &shared.Datetime{Time: time.Now()}}}) {
+			t.Errorf("expected the visit of %q to be queued", id)
+		}
+	}
+
+	// the queued visits are written before the queue is closed
+	queue.close()
+	if queue.push(shared.Visit{EntryID: "a"}) {
+		t.Error("expected the visit to be dropped by the closed queue")
+	}
+
+	entry, err := storage.GetEntryByID("a")
+	if err != nil || entry.Public.VisitCount != 3 {
+		t.Errorf("expected 3 visits, got %v (%v)", entry, err)
+	}
+
+	after := VisitMetrics()
+	if after["queued"]-before["queued"] != 4 || after["written"]-before["written"] != 4 || after["dropped"]-before["dropped"] != 1 {
+		t.Errorf("unexpected metrics %v, before %v", after, before)
+	}
+}
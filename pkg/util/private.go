@@ -16,6 +16,10 @@ var privateKey []byte
 // CheckForPrivateKey checks if already an private key exists, if not it will
 // be randomly generated and saved as a private.dat file in the data directory
 func CheckForPrivateKey() error {
+	if err := os.MkdirAll(g.GetConfig().DataDir, 0755); err != nil {
+		return errors.Wrap(err, "could not create data directory")
+	}
+
 	privateDatPath := filepath.Join(g.GetConfig().DataDir, "private.dat")
 	privateDatContent, err := ioutil.ReadFile(privateDatPath)
 	if err == nil {